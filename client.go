@@ -0,0 +1,647 @@
+package tun
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RequestTimeout bounds each request to a local service.
+const RequestTimeout = 30 * time.Second
+
+// drainPoll is how often drain checks for finished requests.
+const drainPoll = 50 * time.Millisecond
+
+// Reconnect delays, before ±25% jitter.
+var delays = []time.Duration{
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	4 * time.Second,
+	8 * time.Second,
+	15 * time.Second,
+	30 * time.Second,
+}
+
+// ErrClientClosed is returned by Client.Run after Close.
+var ErrClientClosed = errors.New("tun: client closed")
+
+// ErrDisconnected is returned by Client.Run after the server
+// disconnects the tunnel on purpose, such as from tund's admin API.
+var ErrDisconnected = errors.New("tun: disconnected by server")
+
+// errGoingAway means tund is shutting down and the client
+// should reconnect right away, likely to its replacement.
+var errGoingAway = errors.New("server going away")
+
+// Rule allows requests with an exact method and path, including any query.
+type Rule struct {
+	Method, Path string
+}
+
+// Route forwards requests whose path is Prefix, or below it by whole
+// segments, to the local base URL Target.
+type Route struct {
+	Prefix, Target string
+}
+
+// ClientOptions configure a Client.
+type ClientOptions struct {
+	// Server is tund's tunnel endpoint, such as "wss://tun.example.com/tunnel".
+	Server string
+	// Token authenticates to tund. It may be empty if TLS
+	// presents a client certificate tund accepts.
+	Token string
+	// User names the tunnel in tund's logs and metrics.
+	User string
+
+	// Local is the base URL requests are forwarded to:
+	// http://, https://, or unix:///path.sock.
+	Local string
+	// Handler serves requests in-process, in place of Local.
+	Handler http.Handler
+	// Routes forward path prefixes to other local URLs.
+	// The longest matching prefix wins; other paths go to Local or Handler.
+	Routes []Route
+	// LocalTLS configures https:// local targets, or nil for defaults.
+	LocalTLS *tls.Config
+	// Allow lists the requests to forward; others get 403 Forbidden.
+	// If empty, no request is forwarded, unless AllowAll is set.
+	Allow []Rule
+	// AllowAll forwards every request, ignoring Allow.
+	AllowAll bool
+	// TCP maps TCP tunnel names to local host:port addresses.
+	TCP map[string]string
+
+	// MaxRequestBody and MaxResponseBody limit body sizes in bytes.
+	// Zero means no limit.
+	MaxRequestBody  int64
+	MaxResponseBody int64
+
+	// IPAllow and IPDeny filter public callers, enforced by tund.
+	IPAllow, IPDeny []netip.Prefix
+	// PublicAuth ("user:pass") and PublicToken make tund require
+	// credentials of public callers.
+	PublicAuth, PublicToken string
+
+	// TLS configures the connection to tund, such as a client certificate.
+	TLS *tls.Config
+	// Proxy is an http:// or socks5:// proxy for reaching tund.
+	// If nil, HTTPS_PROXY, HTTP_PROXY, and NO_PROXY apply.
+	Proxy *url.URL
+
+	// DrainTimeout bounds how long Run waits for in-flight requests
+	// once its context is done. Zero means RequestTimeout; negative
+	// means don't wait.
+	DrainTimeout time.Duration
+
+	// Logger receives the client's logs. It defaults to slog.Default().
+	Logger *slog.Logger
+	// Tracer traces requests to local services, or nil.
+	Tracer *Tracer
+
+	// OnConnect is called after each connection to tund.
+	OnConnect func(ConnectInfo)
+	// OnDisconnect is called when a connection ends, with why.
+	OnDisconnect func(error)
+	// OnRequest is called after each HTTP request is answered.
+	OnRequest func(RequestInfo)
+}
+
+// ConnectInfo describes a connection to tund.
+type ConnectInfo struct {
+	// TCPPorts maps TCP tunnel names to the public ports tund allocated.
+	TCPPorts map[string]int
+}
+
+// RequestInfo describes an answered HTTP request.
+// Client and Server set every field.
+type RequestInfo struct {
+	ID           string
+	Method       string
+	Path         string
+	Status       int
+	Duration     time.Duration
+	Bytes        int64  // response body bytes
+	User         string // of the tunnel
+	RequestBytes int64  // request body bytes
+}
+
+// Client connects to tund and answers the requests it forwards,
+// reconnecting with backoff until its context is done.
+type Client struct {
+	opts     ClientOptions
+	upstream map[string]*upstream // by target URL; Handler under ""
+	log      *slog.Logger         // tagged with the tunnel user
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// NewClient checks opts and returns a client ready to Run.
+func NewClient(opts ClientOptions) (*Client, error) {
+	if opts.Server == "" {
+		return nil, errors.New("tun: Server is required")
+	}
+	if opts.Local == "" && opts.Handler == nil && len(opts.Routes) == 0 {
+		return nil, errors.New("tun: Local, Handler, or Routes is required")
+	}
+	if opts.Local != "" && opts.Handler != nil {
+		return nil, errors.New("tun: set Local or Handler, not both")
+	}
+	if opts.DrainTimeout == 0 {
+		opts.DrainTimeout = RequestTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	routes := make([]Route, len(opts.Routes))
+	for i, r := range opts.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("tun: route prefix %q must start with /", r.Prefix)
+		}
+		routes[i] = Route{strings.TrimSuffix(r.Prefix, "/"), strings.TrimSuffix(r.Target, "/")}
+	}
+	opts.Routes = routes
+
+	ups, err := newUpstreams(opts.Local, opts.Routes, opts.LocalTLS)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Handler != nil {
+		ups[""] = handlerUpstream(opts.Handler)
+	}
+
+	c := &Client{
+		opts:     opts,
+		upstream: ups,
+		log:      opts.Logger,
+		closing:  make(chan struct{}),
+	}
+	if opts.User != "" {
+		c.log = c.log.With("user", opts.User)
+	}
+	return c, nil
+}
+
+// Run connects to tund and serves requests, reconnecting with backoff on
+// errors. When ctx is done, Run tells tund it is draining, waits up to
+// DrainTimeout for in-flight requests, and returns ctx.Err().
+// After Close, it returns ErrClientClosed, and after the server
+// disconnects the tunnel, ErrDisconnected.
+func (c *Client) Run(ctx context.Context) error {
+	attempt := 0
+	for {
+		err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrClientClosed) || errors.Is(err, ErrDisconnected) {
+			return err
+		}
+		if errors.Is(err, errGoingAway) {
+			// tund drained before going away, so reconnect after the
+			// shortest delay. Keeping the delay avoids a hot loop with
+			// a server that keeps going away.
+			c.log.Info("server going away")
+			attempt = 0
+		} else {
+			c.log.Error("connection error", "err", err)
+		}
+
+		delay := delays[min(attempt, len(delays)-1)]
+		delay = time.Duration(float64(delay) * (0.75 + rand.Float64()*0.5)) // ±25%
+		c.log.Info("reconnecting", "delay", delay.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			c.log.Info("interrupted")
+			return ctx.Err()
+		case <-c.closing:
+			return ErrClientClosed
+		case <-time.After(delay):
+		}
+		attempt++
+	}
+}
+
+// Close ends the connection without waiting for in-flight requests,
+// including during Run's drain.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return nil
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	conn, res, err := c.dialer().DialContext(ctx, c.opts.Server, c.header())
+	if err != nil {
+		if c.opts.Proxy != nil {
+			return fmt.Errorf("dial %s via %s: %w", c.opts.Server, c.opts.Proxy.Redacted(), err)
+		}
+		return fmt.Errorf("dial %s: %w", c.opts.Server, err)
+	}
+	sess := NewSession(conn, false)
+	defer sess.Close()
+
+	c.log.Info("connected", "server", c.opts.Server, "local", c.describeTargets())
+	ports := c.logPorts(res.Header.Get("X-Tunnel-TCP"))
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(ConnectInfo{TCPPorts: ports})
+	}
+
+	go c.serve(sess)
+
+	select {
+	case <-sess.GoingAway():
+		// tund drains pending requests before going away.
+		err = errGoingAway
+	case <-sess.Done():
+		if websocket.IsCloseError(sess.Err(), closeDisconnected) {
+			c.log.Error("disconnected by server")
+			err = ErrDisconnected
+			break
+		}
+		c.log.Error("read error", "err", sess.Err())
+		err = errors.New("connection closed")
+	case <-c.closing:
+		err = ErrClientClosed
+	case <-ctx.Done():
+		c.drain(sess)
+		err = ctx.Err()
+	}
+	if c.opts.OnDisconnect != nil {
+		c.opts.OnDisconnect(err)
+	}
+	return err
+}
+
+// header returns the tunnel handshake headers.
+func (c *Client) header() http.Header {
+	h := http.Header{}
+	if c.opts.Token != "" {
+		h.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	if c.opts.User != "" {
+		h.Set("X-Tunnel-User", c.opts.User)
+	}
+	if len(c.opts.TCP) > 0 {
+		h.Set("X-Tunnel-TCP", tcpNames(c.opts.TCP))
+	}
+	if len(c.opts.IPAllow) > 0 {
+		h.Set("X-Tunnel-IP-Allow", joinPrefixes(c.opts.IPAllow))
+	}
+	if len(c.opts.IPDeny) > 0 {
+		h.Set("X-Tunnel-IP-Deny", joinPrefixes(c.opts.IPDeny))
+	}
+	if c.opts.PublicAuth != "" {
+		h.Set("X-Tunnel-Public-Auth", c.opts.PublicAuth)
+	}
+	if c.opts.PublicToken != "" {
+		h.Set("X-Tunnel-Public-Token", c.opts.PublicToken)
+	}
+	return h
+}
+
+func joinPrefixes(ps []netip.Prefix) string {
+	s := make([]string, len(ps))
+	for i, p := range ps {
+		s[i] = p.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// drain tells tund to route no more requests to sess, then waits up to
+// DrainTimeout for in-flight HTTP requests, or until Close. The session
+// counts requests from when tund opens them, so those not yet accepted
+// are waited for too. TCP connections are not; they close with the
+// session.
+func (c *Client) drain(sess *Session) {
+	sess.GoAway()
+	if n := sess.pending(); n > 0 {
+		c.log.Info("draining", "pending", n, "timeout", c.opts.DrainTimeout)
+	}
+
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	deadline := time.After(c.opts.DrainTimeout)
+	for sess.pending() > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			n := sess.pending()
+			c.log.Error("drain timed out", "pending", n)
+			return
+		case <-c.closing:
+			c.log.Info("interrupted again, closing")
+			return
+		case <-sess.Done():
+			return
+		}
+	}
+}
+
+// serve handles streams opened by tund until sess ends.
+func (c *Client) serve(sess *Session) {
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleStream(st)
+	}
+}
+
+// handleStream serves one stream opened by tund.
+// The session counts it as pending until it returns.
+func (c *Client) handleStream(st *Stream) {
+	defer st.release()
+	defer st.Close()
+
+	var req Request
+	if err := json.Unmarshal(st.Header(), &req); err != nil {
+		c.log.Error("invalid request", "err", err)
+		st.Reset()
+		return
+	}
+	if req.TCP != "" {
+		st.release() // TCP connections may stay open indefinitely; don't drain them
+		c.handleTCP(st, req)
+		return
+	}
+	c.handleRequest(st, req)
+}
+
+func (c *Client) handleRequest(st *Stream, req Request) {
+	start := time.Now()
+	logger := c.log.With("request_id", req.ID, "method", req.Method, "path", req.Path)
+
+	body := &countingReader{r: st}
+	status, n := c.forward(st, body, req, logger)
+
+	d := time.Since(start)
+	logger.Info("request",
+		"status", status,
+		"duration_ms", ms(d),
+		"bytes", n,
+	)
+	if c.opts.OnRequest != nil {
+		c.opts.OnRequest(RequestInfo{
+			ID:           req.ID,
+			Method:       req.Method,
+			Path:         req.Path,
+			Status:       status,
+			Duration:     d,
+			Bytes:        n,
+			User:         c.opts.User,
+			RequestBytes: body.n,
+		})
+	}
+}
+
+// requestContext returns the context for the local request serving st,
+// cancelled when tund resets the stream, the session ends, or the
+// client closes.
+func (c *Client) requestContext(st *Stream) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-st.Done():
+		case <-c.closing:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// forward answers req on st, reading its body from in, and returns
+// the status sent to tund and the number of response body bytes.
+func (c *Client) forward(st *Stream, in io.Reader, req Request, logger *slog.Logger) (int, int64) {
+	if !c.opts.AllowAll && !allowed(c.opts.Allow, req.Method, req.Path) {
+		logger.Warn("blocked by allow list")
+		return c.respond(st, logger, Response{Status: http.StatusForbidden}, []byte("forbidden by tunnel filter"))
+	}
+
+	// The empty target is the Handler, if any.
+	up := c.upstream[c.target(req.Path)]
+	if up == nil {
+		logger.Warn("no route")
+		return c.respond(st, logger, Response{Status: http.StatusBadGateway}, []byte("no local target for path"))
+	}
+
+	maxReq, maxRes := c.opts.MaxRequestBody, c.opts.MaxResponseBody
+	if maxReq > 0 && req.Length > maxReq {
+		msg := fmt.Sprintf("request body exceeds TUN_MAX_REQUEST_BODY (%d bytes)", maxReq)
+		logger.Warn("request body too large", "limit", maxReq)
+		return c.respond(st, logger, Response{Status: http.StatusRequestEntityTooLarge}, []byte(msg))
+	}
+
+	// The transport closes request bodies; the stream outlives the request.
+	src := in
+	if maxReq > 0 {
+		src = &limitedBody{r: in, n: maxReq}
+	}
+	body := io.NopCloser(src)
+	if req.Length == 0 {
+		body = http.NoBody
+	}
+	ctx, cancel := c.requestContext(st)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, req.Method, up.base+req.Path, body)
+	if err != nil {
+		return c.respond(st, logger, Response{Status: http.StatusInternalServerError}, []byte(err.Error()))
+	}
+	r.ContentLength = req.Length
+	for k, vs := range req.Headers {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	r.Header.Set("X-Request-ID", req.ID)
+
+	// Trace the local call as a child of tund's span, and make it
+	// the parent of the local service's spans.
+	span := c.opts.Tracer.Start(req.Method, SpanClient, r.Header.Get("Traceparent"))
+	defer span.Finish()
+	if tp := span.Traceparent(); tp != "" {
+		r.Header.Set("Traceparent", tp)
+	}
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("url.full", r.URL.String())
+	span.SetAttr("tun.request_id", req.ID)
+
+	res, err := up.client.Do(r)
+	if errors.Is(err, errBodyTooLarge) {
+		msg := fmt.Sprintf("request body exceeds TUN_MAX_REQUEST_BODY (%d bytes)", maxReq)
+		logger.Warn("request body too large", "limit", maxReq)
+		span.SetError()
+		return c.respond(st, logger, Response{Status: http.StatusRequestEntityTooLarge}, []byte(msg))
+	}
+	if err != nil {
+		logger.Error("local request error", "err", err)
+		span.SetAttr("error.type", err.Error())
+		span.SetError()
+		return c.respond(st, logger, Response{Status: http.StatusBadGateway}, []byte(err.Error()))
+	}
+	defer res.Body.Close()
+
+	span.SetAttr("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 400 {
+		span.SetError()
+	}
+
+	if maxRes > 0 && res.ContentLength > maxRes {
+		msg := fmt.Sprintf("response body exceeds TUN_MAX_RESPONSE_BODY (%d bytes)", maxRes)
+		logger.Warn("response body too large", "limit", maxRes)
+		span.SetAttr("error.type", "response body too large")
+		span.SetError()
+		return c.respond(st, logger, Response{Status: http.StatusBadGateway}, []byte(msg))
+	}
+
+	var resBody io.Reader = res.Body
+	if maxRes > 0 {
+		resBody = &limitedBody{r: res.Body, n: maxRes}
+	}
+	status, _ := c.respond(st, logger, Response{Status: res.StatusCode, Headers: res.Header}, nil)
+	n, err := io.Copy(st, resBody)
+	if errors.Is(err, errBodyTooLarge) {
+		// The status is already sent; abort so tund sees a truncated body.
+		logger.Error("response body too large", "limit", maxRes)
+		span.SetAttr("error.type", "response body too large")
+		span.SetError()
+		st.Reset()
+	} else if err != nil {
+		logger.Error("read body error", "err", err)
+		st.Reset()
+	}
+	return status, n
+}
+
+// respond writes the response line and an optional body to st,
+// returning the status and body bytes written.
+func (c *Client) respond(st *Stream, logger *slog.Logger, resp Response, body []byte) (int, int64) {
+	line, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("marshal error", "err", err)
+		st.Reset()
+		return resp.Status, 0
+	}
+	if _, err := st.Write(append(line, '\n')); err != nil {
+		logger.Error("write error", "err", err)
+		return resp.Status, 0
+	}
+	n, err := st.Write(body)
+	if err != nil {
+		logger.Error("write error", "err", err)
+	}
+	return resp.Status, int64(n)
+}
+
+func allowed(rules []Rule, method, path string) bool {
+	for _, r := range rules {
+		if r.Method == method && r.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the local base URL for path.
+// The longest matching route prefix wins; unmatched paths go to Local,
+// or to Handler as the empty target.
+// Prefixes match whole path segments, so /api matches /api/x but not /apix.
+func (c *Client) target(path string) string {
+	p, _, _ := strings.Cut(path, "?")
+	best, target := -1, c.opts.Local
+	for _, r := range c.opts.Routes {
+		if len(r.Prefix) <= best {
+			continue
+		}
+		if r.Prefix == "" || p == r.Prefix || strings.HasPrefix(p, r.Prefix+"/") {
+			best, target = len(r.Prefix), r.Target
+		}
+	}
+	return target
+}
+
+func (c *Client) describeTargets() string {
+	var parts []string
+	for _, r := range c.opts.Routes {
+		parts = append(parts, r.Prefix+"/ -> "+r.Target)
+	}
+	switch {
+	case c.opts.Local != "":
+		parts = append(parts, c.opts.Local)
+	case c.opts.Handler != nil:
+		parts = append(parts, "handler")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tcpNames returns the tunnel names sent to tund in X-Tunnel-TCP.
+func tcpNames(tcp map[string]string) string {
+	var names []string
+	for name := range tcp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// logPorts logs the public ports tund allocated, from its "name=port ..."
+// handshake response header, and returns them by name.
+func (c *Client) logPorts(header string) map[string]int {
+	ports := make(map[string]int)
+	for _, f := range strings.Fields(header) {
+		name, port, _ := strings.Cut(f, "=")
+		c.log.Info("tcp tunnel open",
+			"tcp", name,
+			"port", port,
+			"local", c.opts.TCP[name],
+		)
+		if n, err := strconv.Atoi(port); err == nil {
+			ports[name] = n
+		}
+	}
+	return ports
+}
+
+// handleTCP relays a TCP stream opened by tund to the named local address.
+func (c *Client) handleTCP(st *Stream, req Request) {
+	name := req.TCP
+	logger := c.log.With("request_id", req.ID, "tcp", name)
+	addr, ok := c.opts.TCP[name]
+	if !ok {
+		logger.Warn("unknown tcp tunnel")
+		st.Reset()
+		return
+	}
+	conn, err := net.DialTimeout("tcp", addr, RequestTimeout)
+	if err != nil {
+		logger.Error("tcp dial error", "err", err)
+		st.Reset()
+		return
+	}
+	logger.Info("tcp connection open")
+	Pipe(st, conn)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,559 @@
+package tun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNewClientErrors(t *testing.T) {
+	h := http.NotFoundHandler()
+	tests := []struct {
+		name string
+		opts ClientOptions
+	}{
+		{"no server", ClientOptions{Local: "http://localhost:3000"}},
+		{"no target", ClientOptions{Server: "ws://tund/tunnel"}},
+		{"local and handler", ClientOptions{Server: "ws://tund/tunnel", Local: "http://localhost:3000", Handler: h}},
+		{"bad local", ClientOptions{Server: "ws://tund/tunnel", Local: "ftp://localhost"}},
+		{"bad route prefix", ClientOptions{Server: "ws://tund/tunnel", Routes: []Route{{"api", "http://localhost:3000"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewClient(tt.opts); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	rules := []Rule{{"POST", "/slack/events"}, {"GET", "/health"}}
+
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{"POST", "/slack/events", true},
+		{"GET", "/health", true},
+		{"GET", "/slack/events", false},
+		{"POST", "/health", false},
+		{"POST", "/other", false},
+		{"DELETE", "/slack/events", false},
+		{"POST", "/slack/events/", false},
+		{"POST", "/Slack/Events", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if got := allowed(rules, tt.method, tt.path); got != tt.want {
+				t.Errorf("allowed(%q, %q) = %v, want %v", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTarget(t *testing.T) {
+	routes := []Route{
+		{"/api", "http://localhost:3000"},
+		{"/api/webhooks/", "http://localhost:4000/"},
+	}
+
+	tests := []struct {
+		local string
+		path  string
+		want  string
+	}{
+		{"http://localhost:5000", "/api", "http://localhost:3000"},
+		{"http://localhost:5000", "/api/users?page=2", "http://localhost:3000"},
+		{"http://localhost:5000", "/api/webhooks/stripe", "http://localhost:4000"},
+		{"http://localhost:5000", "/apix", "http://localhost:5000"},
+		{"http://localhost:5000", "/slack/events", "http://localhost:5000"},
+		{"", "/slack/events", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			c, err := NewClient(ClientOptions{Server: "ws://tund/tunnel", Local: tt.local, Routes: routes})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.target(tt.path); got != tt.want {
+				t.Errorf("target(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTCPNames(t *testing.T) {
+	got := tcpNames(map[string]string{"ssh": "localhost:22", "pg": "localhost:5432"})
+	if want := "pg ssh"; got != want {
+		t.Errorf("tcpNames = %q, want %q", got, want)
+	}
+}
+
+// fakeTund accepts tunnel connections, answering the handshake with
+// header, and returns each client's session.
+func fakeTund(t *testing.T, header http.Header) (string, <-chan *Session) {
+	t.Helper()
+	ch := make(chan *Session, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		sess := NewSession(conn, true)
+		t.Cleanup(func() { _ = sess.Close() })
+		ch <- sess
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel", ch
+}
+
+// get opens a request stream on srv and returns the response status.
+func get(srv *Session, path string) (int, error) {
+	status, _, err := request(srv, Request{ID: "r1", Method: "GET", Path: path}, "")
+	return status, err
+}
+
+// request sends req with body on srv and returns the response.
+func request(srv *Session, req Request, body string) (int, string, error) {
+	req.Length = int64(len(body))
+	hdr, _ := json.Marshal(req)
+	st, err := srv.Open(hdr)
+	if err != nil {
+		return 0, "", err
+	}
+	defer st.Close()
+	_, _ = st.Write([]byte(body))
+	_ = st.CloseWrite()
+	r := bufio.NewReader(st)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return 0, "", err
+	}
+	b, err := io.ReadAll(r)
+	return resp.Status, string(b), err
+}
+
+func TestClientHandler(t *testing.T) {
+	hdr := http.Header{}
+	hdr.Set("X-Tunnel-TCP", "pg=40001")
+	server, sessions := fakeTund(t, hdr)
+
+	connected := make(chan ConnectInfo, 1)
+	disconnected := make(chan error, 1)
+	requests := make(chan RequestInfo, 1)
+	c, err := NewClient(ClientOptions{
+		Server: server,
+		Token:  "secret",
+		User:   "croaky",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+		}),
+		Allow:        []Rule{{"POST", "/hook?x=1"}},
+		TCP:          map[string]string{"pg": "localhost:5432"},
+		OnConnect:    func(ci ConnectInfo) { connected <- ci },
+		OnDisconnect: func(err error) { disconnected <- err },
+		OnRequest:    func(ri RequestInfo) { requests <- ri },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	srv := <-sessions
+	if ci := <-connected; ci.TCPPorts["pg"] != 40001 {
+		t.Errorf("OnConnect TCPPorts = %v, want pg=40001", ci.TCPPorts)
+	}
+
+	status, body, err := request(srv, Request{ID: "r1", Method: "POST", Path: "/hook?x=1"}, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusAccepted || body != "POST /hook?x=1 hi" {
+		t.Errorf("got %d %q, want 202 %q", status, body, "POST /hook?x=1 hi")
+	}
+	ri := <-requests
+	if ri.ID != "r1" || ri.Status != http.StatusAccepted || ri.Bytes != int64(len(body)) || ri.User != "croaky" || ri.RequestBytes != 2 {
+		t.Errorf("OnRequest = %+v", ri)
+	}
+
+	if status, _ := get(srv, "/other"); status != http.StatusForbidden {
+		t.Errorf("disallowed request status = %d, want 403", status)
+	}
+	<-requests
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if err := <-disconnected; !errors.Is(err, context.Canceled) {
+		t.Errorf("OnDisconnect err = %v, want context.Canceled", err)
+	}
+	select {
+	case <-srv.GoingAway():
+	case <-time.After(5 * time.Second):
+		t.Error("tund did not get GoAway")
+	}
+}
+
+func TestClientCancelsLocal(t *testing.T) {
+	server, sessions := fakeTund(t, nil)
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	c, err := NewClient(ClientOptions{
+		Server: server,
+		Token:  "secret",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+		}),
+		AllowAll: true,
+		Logger:   slog.New(slog.DiscardHandler),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	srv := <-sessions
+
+	open := func() *Stream {
+		hdr, _ := json.Marshal(Request{ID: "r1", Method: "GET", Path: "/slow"})
+		st, err := srv.Open(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = st.CloseWrite()
+		<-started
+		return st
+	}
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s did not cancel the local request", what)
+		}
+	}
+
+	// tund resets the stream when the public caller goes away.
+	open().Reset()
+	wait("Reset")
+
+	open()
+	_ = c.Close()
+	wait("Close")
+	if err := <-done; !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Run = %v, want ErrClientClosed", err)
+	}
+}
+
+func TestClientGoingAway(t *testing.T) {
+	server, sessions := fakeTund(t, nil)
+	c, err := NewClient(ClientOptions{Server: server, Token: "secret", Handler: http.NotFoundHandler()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+
+	// The client reconnects after the shortest delay when tund goes away.
+	first := <-sessions
+	start := time.Now()
+	first.GoAway()
+	select {
+	case <-sessions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect after GoAway")
+	}
+	if d := time.Since(start); d < delays[0]*3/4 {
+		t.Errorf("reconnected after %s, want at least %s", d, delays[0]*3/4)
+	}
+
+	_ = c.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClientClosed) {
+			t.Errorf("Run = %v, want ErrClientClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+func TestClientDisconnected(t *testing.T) {
+	ts, err := NewServer(ServerOptions{Authenticator: TokenAuth("secret"), Logger: slog.New(slog.DiscardHandler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ts)
+	t.Cleanup(srv.Close)
+
+	connected := make(chan struct{}, 2)
+	c, err := NewClient(ClientOptions{
+		Server:    "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel",
+		Token:     "secret",
+		Handler:   http.NotFoundHandler(),
+		Logger:    slog.New(slog.DiscardHandler),
+		OnConnect: func(ConnectInfo) { connected <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	t.Cleanup(func() { _ = c.Close() })
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not connect")
+	}
+	tunnels := ts.Tunnels()
+	if len(tunnels) != 1 || !ts.Disconnect(tunnels[0].ID) {
+		t.Fatalf("tunnels = %+v, want one to disconnect", tunnels)
+	}
+
+	// The client stops rather than reconnecting.
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDisconnected) {
+			t.Errorf("Run = %v, want ErrDisconnected", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Disconnect")
+	}
+	if len(connected) != 0 {
+		t.Error("client reconnected after Disconnect")
+	}
+}
+
+func TestClientAllowDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowAll bool
+		want     int
+	}{
+		{"empty allow", false, http.StatusForbidden},
+		{"allow all", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, sessions := fakeTund(t, nil)
+			c, err := NewClient(ClientOptions{
+				Server:   server,
+				Token:    "secret",
+				Handler:  http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+				AllowAll: tt.allowAll,
+				Logger:   slog.New(slog.DiscardHandler),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() { _ = c.Run(context.Background()) }()
+			t.Cleanup(func() { _ = c.Close() })
+
+			if status, _ := get(<-sessions, "/anything"); status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+// drainSetup connects a client to a stand-in for tund and returns
+// tund's session and the client's, which the caller serves. The client
+// forwards GET /slow to a local service that answers once release is
+// closed.
+func drainSetup(t *testing.T, release <-chan struct{}, timeout time.Duration) (*Client, *Session, *Session, <-chan struct{}) {
+	t.Helper()
+	hit := make(chan struct{}, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(local.Close)
+
+	ch := make(chan *Session, 1)
+	up := websocket.Upgrader{}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ch <- NewSession(conn, true)
+	}))
+	t.Cleanup(hs.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/tunnel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := NewSession(conn, false)
+	srv := <-ch
+	t.Cleanup(func() {
+		_ = cli.Close()
+		_ = srv.Close()
+	})
+
+	c, err := NewClient(ClientOptions{
+		Server:       "ws://tund/tunnel",
+		Local:        local.URL,
+		Allow:        []Rule{{"GET", "/slow"}},
+		DrainTimeout: timeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv, cli, hit
+}
+
+func TestDrain(t *testing.T) {
+	release := make(chan struct{})
+	c, srv, cli, hit := drainSetup(t, release, 5*time.Second)
+	go c.serve(cli)
+
+	status := make(chan int, 1)
+	go func() {
+		code, err := get(srv, "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		status <- code
+	}()
+	<-hit
+
+	drained := make(chan struct{})
+	go func() {
+		c.drain(cli)
+		close(drained)
+	}()
+
+	select {
+	case <-srv.GoingAway():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tund did not see GoAway")
+	}
+	if _, err := srv.Open(nil); !errors.Is(err, ErrGoingAway) {
+		t.Errorf("open while draining: err = %v, want ErrGoingAway", err)
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want 200", code)
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after requests finished")
+	}
+}
+
+func TestDrainBacklog(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	c, srv, cli, _ := drainSetup(t, release, 5*time.Second)
+
+	// The request reaches the client but is not yet accepted.
+	status := make(chan int, 1)
+	go func() {
+		code, err := get(srv, "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		status <- code
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for cli.pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request did not reach the client")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		c.drain(cli)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a request in the accept backlog")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	go c.serve(cli)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("backlogged request status = %d, want 200", code)
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after requests finished")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c, srv, cli, hit := drainSetup(t, release, 100*time.Millisecond)
+	go c.serve(cli)
+	go func() { _, _ = get(srv, "/slow") }()
+	<-hit
+
+	start := time.Now()
+	c.drain(cli)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("drain took %s with a 100ms timeout", d)
+	}
+
+	// Close stops waiting right away.
+	c.opts.DrainTimeout = time.Minute
+	_ = c.Close()
+	start = time.Now()
+	c.drain(cli)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("drain took %s after Close", d)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// profile is a named tunnel from tun.toml or tun.yaml.
+// The zero profile reads only the environment.
+type profile struct {
+	name  string
+	vars  map[string]string // by TUN_* variable name
+	alone bool              // the only profile started
+}
+
+// lookup returns the TUN_* variable key. The environment overrides the
+// profile: TUN_<NAME>_* variables, such as TUN_SLACK_LOCAL for the
+// profile "slack", and plain TUN_* variables if this is the only profile
+// started, so .env can't point several profiles at one target.
+// A profile "token_env" key names a variable holding TUN_TOKEN.
+func (p profile) lookup(key string) string {
+	if p.name != "" {
+		if v := strings.TrimSpace(os.Getenv(p.envKey(key))); v != "" {
+			return v
+		}
+	}
+	if p.name == "" || p.alone {
+		if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+			return v
+		}
+	}
+	if v := p.vars[key]; v != "" {
+		return v
+	}
+	if ref := p.vars[key+"_ENV"]; ref != "" {
+		return strings.TrimSpace(os.Getenv(ref))
+	}
+	return ""
+}
+
+// envKey returns the variable overriding key for p alone,
+// such as TUN_SLACK_LOCAL for TUN_LOCAL.
+func (p profile) envKey(key string) string {
+	name := strings.ToUpper(strings.ReplaceAll(p.name, "-", "_"))
+	return "TUN_" + name + "_" + strings.TrimPrefix(key, "TUN_")
+}
+
+// loadConfig reads profiles from a tun.toml or, by its extension,
+// tun.yaml file.
+func loadConfig(name string) ([]profile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parse := parseConfig
+	if ext := filepath.Ext(name); ext == ".yaml" || ext == ".yml" {
+		parse = parseYAMLConfig
+	}
+	profiles, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return profiles, nil
+}
+
+// parseConfig parses the subset of TOML that tun.toml uses:
+// [name] tables of key = "string", key = ["string", ...], or
+// key = true pairs, and # comments. Keys are TUN_* variable names
+// without the prefix, in lowercase. Arrays are joined with spaces,
+// and true is "1".
+//
+//	[slack]
+//	server = "wss://tun.example.com/tunnel"
+//	local = "http://localhost:3000"
+//	allow = ["POST /slack/events", "GET /health"]
+//	token_env = "SLACK_TUN_TOKEN"
+func parseConfig(r io.Reader) ([]profile, error) {
+	var profiles []profile
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			name, rest, ok := strings.Cut(line[1:], "]")
+			name = strings.TrimSpace(name)
+			if !ok || !validName(name) || !isComment(rest) {
+				return nil, fmt.Errorf("line %d: invalid table %s", n, line)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("line %d: duplicate profile %q", n, name)
+			}
+			seen[name] = true
+			profiles = append(profiles, profile{name: name, vars: map[string]string{}})
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || !validName(k) {
+			return nil, fmt.Errorf("line %d: want key = value", n)
+		}
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("line %d: %s outside a [profile] table", n, k)
+		}
+		val, err := parseValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, k, err)
+		}
+		if err := setVar(profiles[len(profiles)-1].vars, k, val); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no profiles")
+	}
+	return profiles, nil
+}
+
+// setVar sets the TUN_* variable for config key k to v.
+func setVar(vars map[string]string, k, v string) error {
+	key := "TUN_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+	if _, ok := vars[key]; ok {
+		return fmt.Errorf("duplicate key %s", k)
+	}
+	vars[key] = v
+	return nil
+}
+
+// parseValue parses a string, array of strings, or boolean,
+// followed by an optional comment.
+func parseValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "true"):
+		if !isComment(s[len("true"):]) {
+			break
+		}
+		return "1", nil
+	case strings.HasPrefix(s, "false"):
+		if !isComment(s[len("false"):]) {
+			break
+		}
+		return "", nil
+	case strings.HasPrefix(s, "["):
+		var items []string
+		rest := strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			item, r, err := parseString(rest)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", fmt.Errorf("want , or ] in array")
+			}
+		}
+		if !isComment(rest[1:]) {
+			break
+		}
+		return strings.Join(items, " "), nil
+	default:
+		v, rest, err := parseString(s)
+		if err != nil {
+			return "", err
+		}
+		if !isComment(rest) {
+			break
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("unexpected text after value")
+}
+
+// parseString parses a leading "basic" or 'literal' string
+// and returns it with the text after it.
+func parseString(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return v, s[i+1:], nil
+			}
+		}
+	case strings.HasPrefix(s, "'"):
+		if i := strings.IndexByte(s[1:], '\''); i >= 0 {
+			return s[1 : i+1], s[i+2:], nil
+		}
+	default:
+		return "", "", fmt.Errorf("want a quoted string")
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// isComment reports whether s is blank or a comment.
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// validName reports whether s is a bare TOML key.
+func validName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
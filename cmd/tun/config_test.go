@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+# Webhook tunnels
+[slack]
+server = "wss://tun.example.com/tunnel"
+local = "http://localhost:3000" # the Rails app
+allow = ["POST /slack/events", "GET /health"]
+token_env = "SLACK_TUN_TOKEN"
+
+[stripe]
+server = 'wss://stripe.tun.example.com/tunnel'
+routes = [ "/webhooks http://localhost:4000" ]
+allow = ["POST /webhooks/stripe",]
+local-insecure = true
+public_auth = "user:p\"ss"
+`
+
+func TestParseConfig(t *testing.T) {
+	profiles, err := parseConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []profile{
+		{name: "slack", vars: map[string]string{
+			"TUN_SERVER":    "wss://tun.example.com/tunnel",
+			"TUN_LOCAL":     "http://localhost:3000",
+			"TUN_ALLOW":     "POST /slack/events GET /health",
+			"TUN_TOKEN_ENV": "SLACK_TUN_TOKEN",
+		}},
+		{name: "stripe", vars: map[string]string{
+			"TUN_SERVER":         "wss://stripe.tun.example.com/tunnel",
+			"TUN_ROUTES":         "/webhooks http://localhost:4000",
+			"TUN_ALLOW":          "POST /webhooks/stripe",
+			"TUN_LOCAL_INSECURE": "1",
+			"TUN_PUBLIC_AUTH":    `user:p"ss`,
+		}},
+	}
+	if !reflect.DeepEqual(profiles, want) {
+		t.Errorf("got %+v, want %+v", profiles, want)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"empty", "# nothing\n"},
+		{"key outside table", "server = \"ws://tund\"\n"},
+		{"unclosed table", "[slack\n"},
+		{"nested table", "[tun.slack]\n"},
+		{"duplicate profile", "[slack]\n[slack]\n"},
+		{"duplicate key", "[slack]\nlocal = \"a\"\nlocal = \"b\"\n"},
+		{"missing equals", "[slack]\nlocal\n"},
+		{"bare value", "[slack]\nlocal = http://localhost\n"},
+		{"unterminated string", "[slack]\nlocal = \"http://localhost\n"},
+		{"unterminated array", "[slack]\nallow = [\"POST /a\"\n"},
+		{"trailing text", "[slack]\nlocal = \"a\" b\n"},
+		{"number", "[slack]\nport = 3000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseConfig(strings.NewReader(tt.config)); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestProfileLookup(t *testing.T) {
+	p := profile{name: "slack", vars: map[string]string{
+		"TUN_LOCAL":     "http://localhost:3000",
+		"TUN_TOKEN_ENV": "SLACK_TUN_TOKEN",
+	}}
+	t.Setenv("TUN_LOCAL", "")
+	t.Setenv("TUN_TOKEN", "")
+	t.Setenv("TUN_SLACK_LOCAL", "")
+	t.Setenv("SLACK_TUN_TOKEN", "secret")
+
+	if got := p.lookup("TUN_LOCAL"); got != "http://localhost:3000" {
+		t.Errorf("TUN_LOCAL = %q, want profile value", got)
+	}
+	if got := p.lookup("TUN_TOKEN"); got != "secret" {
+		t.Errorf("TUN_TOKEN = %q, want value of SLACK_TUN_TOKEN", got)
+	}
+
+	// Plain TUN_* variables, such as from .env, override only a
+	// profile started alone.
+	t.Setenv("TUN_LOCAL", "http://localhost:5000")
+	t.Setenv("TUN_TOKEN", "override")
+	if got := p.lookup("TUN_LOCAL"); got != "http://localhost:3000" {
+		t.Errorf("TUN_LOCAL = %q, want profile value", got)
+	}
+	p.alone = true
+	if got := p.lookup("TUN_LOCAL"); got != "http://localhost:5000" {
+		t.Errorf("TUN_LOCAL alone = %q, want environment value", got)
+	}
+	if got := p.lookup("TUN_TOKEN"); got != "override" {
+		t.Errorf("TUN_TOKEN alone = %q, want environment value", got)
+	}
+
+	// TUN_SLACK_* variables override the profile either way.
+	t.Setenv("TUN_SLACK_LOCAL", "http://localhost:6000")
+	for _, alone := range []bool{false, true} {
+		p.alone = alone
+		if got := p.lookup("TUN_LOCAL"); got != "http://localhost:6000" {
+			t.Errorf("TUN_LOCAL (alone %v) = %q, want TUN_SLACK_LOCAL", alone, got)
+		}
+	}
+}
+
+func TestSelectProfiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tun.toml")
+	if err := os.WriteFile(file, []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(ps []profile) []string {
+		var out []string
+		for _, p := range ps {
+			out = append(out, p.name)
+		}
+		return out
+	}
+	tests := []struct {
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"--all"}, []string{"slack", "stripe"}, false},
+		{[]string{"stripe"}, []string{"stripe"}, false},
+		{[]string{"stripe", "slack"}, []string{"stripe", "slack"}, false},
+		{[]string{"github"}, nil, true},
+		{[]string{"slack", "slack"}, nil, true}, // same server
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			got, err := selectProfiles(file, tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("got %v, want %v", names(got), tt.want)
+			}
+		})
+	}
+
+	if _, err := selectProfiles(filepath.Join(t.TempDir(), "missing.toml"), []string{"--all"}); err == nil {
+		t.Error("missing config file: want error")
+	}
+
+	// Plain TUN_* variables apply only to a profile started alone,
+	// so they can't point several at one server.
+	t.Setenv("TUN_SERVER", "wss://other.example.com/tunnel")
+	if _, err := selectProfiles(file, []string{"--all"}); err != nil {
+		t.Errorf("--all with TUN_SERVER: %v", err)
+	}
+	t.Setenv("TUN_STRIPE_SERVER", "wss://tun.example.com/tunnel")
+	if _, err := selectProfiles(file, []string{"--all"}); err == nil {
+		t.Error("--all with TUN_STRIPE_SERVER sharing slack's: want error")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	for _, k := range []string{"TUN_SERVER", "TUN_LOCAL", "TUN_ALLOW", "TUN_TOKEN", "TUN_ROUTES", "TUN_LOCAL_INSECURE", "TUN_PUBLIC_AUTH", "TUN_STRIPE_TOKEN"} {
+		t.Setenv(k, "")
+	}
+	t.Setenv("SLACK_TUN_TOKEN", "secret")
+	profiles, err := parseConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := clientOptions(profiles[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Server != "wss://tun.example.com/tunnel" || opts.Local != "http://localhost:3000" || opts.Token != "secret" || len(opts.Allow) != 2 {
+		t.Errorf("slack options = %+v", opts)
+	}
+
+	// stripe has no token.
+	if _, err := clientOptions(profiles[1], nil); err == nil {
+		t.Error("profile without token: want error")
+	}
+	t.Setenv("TUN_TOKEN", "ignored")
+	if _, err := clientOptions(profiles[1], nil); err == nil {
+		t.Error("TUN_TOKEN with several profiles: want error")
+	}
+	t.Setenv("TUN_STRIPE_TOKEN", "override")
+	opts, err = clientOptions(profiles[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Token != "override" || len(opts.Routes) != 1 || opts.PublicAuth != `user:p"ss` {
+		t.Errorf("stripe options = %+v", opts)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// tlsOptions configure verification of https:// local targets.
+type tlsOptions struct {
+	caFile   string // PEM bundle trusted in addition to system roots
+	insecure bool   // skip verification; localhost targets only
+}
+
+// config returns the TLS config for the https:// targets,
+// or nil if neither option is set.
+func (o tlsOptions) config(targets []string) (*tls.Config, error) {
+	if !o.insecure && o.caFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if o.insecure {
+		for _, target := range targets {
+			u, err := url.Parse(target)
+			if err != nil || u.Scheme != "https" {
+				continue
+			}
+			if !isLocalhost(u.Hostname()) {
+				return nil, fmt.Errorf("TUN_LOCAL_INSECURE only applies to localhost, not %s", u.Hostname())
+			}
+		}
+		cfg.InsecureSkipVerify = true
+	}
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read TUN_LOCAL_CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TUN_LOCAL_CA %s: no certificates found", o.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func isLocalhost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSOptions(t *testing.T) {
+	cfg, err := tlsOptions{}.config([]string{"https://example.com"})
+	if cfg != nil || err != nil {
+		t.Errorf("no options: got %v, %v; want nil", cfg, err)
+	}
+
+	cfg, err = tlsOptions{insecure: true}.config([]string{"http://example.com", "https://localhost:8443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.InsecureSkipVerify {
+		t.Error("insecure localhost: InsecureSkipVerify = false")
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		targets []string
+		opts    tlsOptions
+	}{
+		{"insecure remote host", []string{"https://example.com"}, tlsOptions{insecure: true}},
+		{"missing CA file", []string{"https://localhost:8443"}, tlsOptions{caFile: "/nonexistent/ca.pem"}},
+		{"empty CA file", []string{"https://localhost:8443"}, tlsOptions{caFile: empty}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.opts.config(tt.targets); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestIsLocalhost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost", true},
+		{"app.localhost", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"example.com", false},
+		{"10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := isLocalhost(tt.host); got != tt.want {
+				t.Errorf("isLocalhost(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
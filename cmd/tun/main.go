@@ -1,278 +1,314 @@
 // Command tun is the tunnel client.
 // Run this locally to forward requests from the tunnel server to a local service.
+// It configures a tun.Client from the environment,
+// or one per profile in tun.toml or tun.yaml.
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"math/rand/v2"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
-
 	"github.com/croaky/tun"
 )
 
-type rule struct {
-	method, path string
-}
-
-type client struct {
-	conn  *websocket.Conn
-	mu    sync.Mutex
-	local string
-	rules []rule
-	user  string
-}
-
-func (c *client) logf(format string, args ...any) {
-	if c.user != "" {
-		log.Printf("["+c.user+"] "+format, args...)
-	} else {
-		log.Printf(format, args...)
-	}
-}
-
 func main() {
-	log.SetFlags(0)
 	tun.Load(".env")
+	slog.SetDefault(tun.NewLogger(os.Stderr, strings.TrimSpace(os.Getenv("TUN_LOG_FORMAT"))))
+
+	// "tun playback fixtures.json" answers from recorded responses
+	// instead of a local service, so TUN_LOCAL is not needed.
+	// "tun record fixtures.json" saves TUN_LOCAL's responses for it.
+	// "tun start name..." runs profiles from tun.toml or tun.yaml.
+	profiles := []profile{{}}
+	var handler http.Handler
+	var recordFile string
+	switch {
+	case len(os.Args) == 1:
+	case os.Args[1] == "playback" && len(os.Args) == 3:
+		fixtures, err := loadFixtures(os.Args[2])
+		if err != nil {
+			fatal("config error", "err", err)
+		}
+		handler = playback(fixtures)
+		slog.Info("playing back", "file", os.Args[2])
+	case os.Args[1] == "record" && len(os.Args) == 3:
+		recordFile = os.Args[2]
+	case os.Args[1] == "start" && len(os.Args) > 2:
+		var err error
+		profiles, err = selectProfiles(configFile(), os.Args[2:])
+		if err != nil {
+			fatal("config error", "err", err)
+		}
+	default:
+		fatal("usage: tun [playback fixtures.json | record fixtures.json | start name... | start --all]")
+	}
 
-	server := strings.TrimSpace(os.Getenv("TUN_SERVER"))
-	local := strings.TrimSpace(os.Getenv("TUN_LOCAL"))
-	allow := strings.TrimSpace(os.Getenv("TUN_ALLOW"))
-	token := strings.TrimSpace(os.Getenv("TUN_TOKEN"))
+	tracer := tun.NewTracer(strings.TrimSpace(os.Getenv("TUN_OTLP_ENDPOINT")), "tun")
+	defer tracer.Close()
 
-	if server == "" || local == "" || allow == "" || token == "" {
-		log.Fatal("set TUN_SERVER, TUN_LOCAL, TUN_ALLOW, and TUN_TOKEN in environment or .env")
-	}
-	if _, err := url.ParseRequestURI(server); err != nil {
-		log.Fatalf("invalid TUN_SERVER: %v", err)
+	var clients []*tun.Client
+	for _, p := range profiles {
+		opts, err := clientOptions(p, handler)
+		if err != nil {
+			if p.name != "" {
+				fatal("config error", "profile", p.name, "err", err)
+			}
+			fatal("config error", "err", err)
+		}
+		if recordFile != "" {
+			if len(opts.Routes) > 0 {
+				fatal("record mode forwards only to TUN_LOCAL; unset TUN_ROUTES")
+			}
+			rec, err := newRecorder(recordFile, opts.Local, opts.LocalTLS)
+			if err != nil {
+				fatal("config error", "err", err)
+			}
+			opts.Handler, opts.Local = rec, ""
+			slog.Info("recording", "file", recordFile)
+		}
+		opts.Tracer = tracer
+		if p.name != "" {
+			opts.Logger = slog.With("profile", p.name)
+		}
+		c, err := tun.NewClient(opts)
+		if err != nil {
+			fatal("config error", "err", err)
+		}
+		clients = append(clients, c)
 	}
 
-	rules, err := parseRules(strings.Fields(allow))
-	if err != nil {
-		log.Fatalf("error: %v", err)
+	// The first signal drains in-flight requests; a second stops waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		cancel()
+		<-interrupt
+		for _, c := range clients {
+			_ = c.Close()
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Go(func() { _ = c.Run(ctx) })
 	}
-
-	run(server, local, token, rules)
+	wg.Wait()
 }
 
-var delays = []time.Duration{
-	500 * time.Millisecond,
-	1 * time.Second,
-	2 * time.Second,
-	4 * time.Second,
-	8 * time.Second,
-	15 * time.Second,
-	30 * time.Second,
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-const (
-	requestTimeout = 30 * time.Second
-	writeWait      = 5 * time.Second
-)
-
-// run connects to the tunnel server and forwards requests to the local service.
-// It reconnects with backoff on connection errors.
-func run(server, local, token string, rules []rule) {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	attempt := 0
-	for {
-		err := connect(server, local, token, rules, interrupt)
-		if err == nil {
-			return // graceful shutdown
-		}
-		log.Printf("connection error: %v", err)
-
-		delay := delays[min(attempt, len(delays)-1)]
-		delay = time.Duration(float64(delay) * (0.75 + rand.Float64()*0.5)) // ±25%
-		log.Printf("reconnecting in %s...", delay)
-
-		select {
-		case <-interrupt:
-			log.Println("interrupted")
-			return
-		case <-time.After(delay):
+// configFile returns the config file path: TUN_CONFIG if set,
+// else tun.toml, or tun.yaml or tun.yml if there is no tun.toml.
+func configFile() string {
+	if name := strings.TrimSpace(os.Getenv("TUN_CONFIG")); name != "" {
+		return name
+	}
+	for _, name := range []string{"tun.toml", "tun.yaml", "tun.yml"} {
+		if _, err := os.Stat(name); err == nil {
+			return name
 		}
-		attempt++
 	}
+	return "tun.toml"
 }
 
-func connect(server, local, token string, rules []rule, interrupt chan os.Signal) error {
-	user := getUser()
-
-	h := http.Header{}
-	h.Set("Authorization", "Bearer "+token)
-	if user != "" {
-		h.Set("X-Tunnel-User", user)
-	}
-
-	conn, _, err := websocket.DefaultDialer.Dial(server, h)
+// selectProfiles loads the named profiles from the config file,
+// or all of them for "--all". Profiles may not share a server:
+// tund holds one tunnel at a time, so each would close the other's.
+func selectProfiles(file string, names []string) ([]profile, error) {
+	all, err := loadConfig(file)
 	if err != nil {
-		return fmt.Errorf("dial %s: %w", server, err)
+		return nil, err
 	}
-	defer conn.Close()
-
-	c := &client{
-		conn:  conn,
-		local: local,
-		rules: rules,
-		user:  user,
-	}
-
-	c.logf("connected to %s, forwarding to %s", server, local)
-
-	conn.SetReadDeadline(time.Now().Add(tun.PongWait))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(tun.PongWait))
-		return nil
-	})
-
-	done := make(chan struct{})
-	go func() {
-		t := time.NewTicker(tun.PingPeriod)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				c.mu.Lock()
-				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
-				c.mu.Unlock()
-				if err != nil {
-					log.Printf("ping error: %v", err)
-					return
-				}
-			case <-done:
-				return
+	out := all
+	if len(names) != 1 || names[0] != "--all" {
+		out = nil
+		for _, name := range names {
+			i := slices.IndexFunc(all, func(p profile) bool { return p.name == name })
+			if i < 0 {
+				return nil, fmt.Errorf("profile %q not found in %s", name, file)
 			}
+			out = append(out, all[i])
 		}
-	}()
-
-	go func() {
-		defer close(done)
-		for {
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf("read error: %v", err)
-				return
-			}
-
-			var req tun.Request
-			if err := json.Unmarshal(msg, &req); err != nil {
-				log.Printf("invalid request: %v", err)
-				continue
-			}
+	}
+	if len(out) == 1 {
+		out[0].alone = true
+	}
 
-			go c.handleRequest(req)
+	servers := map[string]string{}
+	for _, p := range out {
+		server := p.lookup("TUN_SERVER")
+		if other, ok := servers[server]; ok && server != "" {
+			return nil, fmt.Errorf("profiles %q and %q share server %s, which holds one tunnel at a time; give each its own tund", other, p.name, server)
 		}
-	}()
-
-	select {
-	case <-done:
-		return fmt.Errorf("connection closed")
-	case <-interrupt:
-		c.mu.Lock()
-		_ = conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		c.mu.Unlock()
-		return nil
+		servers[server] = p.name
 	}
+	return out, nil
 }
 
-func (c *client) handleRequest(req tun.Request) {
-	log.Printf("%s %s", req.Method, req.Path)
+// clientOptions configures a client from p's TUN_* variables.
+// If h is set, it serves requests in place of TUN_LOCAL and TUN_ROUTES.
+func clientOptions(p profile, h http.Handler) (tun.ClientOptions, error) {
+	server := p.lookup("TUN_SERVER")
+	opts := tun.ClientOptions{
+		Server:       server,
+		Local:        p.lookup("TUN_LOCAL"),
+		Token:        p.lookup("TUN_TOKEN"),
+		User:         getUser(),
+		Handler:      h,
+		DrainTimeout: tun.RequestTimeout,
+	}
+	allow := p.lookup("TUN_ALLOW")
+	routes := p.lookup("TUN_ROUTES")
+	tcp := p.lookup("TUN_TCP")
+	if h != nil {
+		opts.Local = ""
+		routes = ""
+	}
 
-	resp := tun.Response{ID: req.ID}
+	var err error
+	opts.TLS, err = serverTLS(
+		p.lookup("TUN_CLIENT_CERT"),
+		p.lookup("TUN_CLIENT_KEY"),
+		p.lookup("TUN_SERVER_CA"),
+	)
+	if err != nil {
+		return opts, err
+	}
+	opts.Proxy, err = parseProxy(p.lookup("TUN_PROXY"))
+	if err != nil {
+		return opts, err
+	}
+	hasCert := opts.TLS != nil && len(opts.TLS.Certificates) > 0
 
-	if !allowed(c.rules, req.Method, req.Path) {
-		log.Printf("blocked: %s %s", req.Method, req.Path)
-		resp.Status = http.StatusForbidden
-		resp.Body = []byte("forbidden by tunnel filter")
-		c.send(resp)
-		return
+	if server == "" || (opts.Local == "" && opts.Handler == nil && routes == "") || allow == "" || (opts.Token == "" && !hasCert) {
+		return opts, errors.New("set TUN_SERVER, TUN_LOCAL (or TUN_ROUTES), TUN_ALLOW, and TUN_TOKEN (or TUN_CLIENT_CERT) in environment or .env")
+	}
+	if _, err := url.ParseRequestURI(server); err != nil {
+		return opts, fmt.Errorf("invalid TUN_SERVER: %w", err)
 	}
 
-	r, err := http.NewRequest(req.Method, c.local+req.Path, bytes.NewReader(req.Body))
+	opts.Allow, err = parseRules(strings.Fields(allow))
 	if err != nil {
-		resp.Status = http.StatusInternalServerError
-		resp.Body = []byte(err.Error())
-		c.send(resp)
-		return
+		return opts, err
+	}
+
+	if routes != "" {
+		opts.Routes, err = parseRoutes(strings.Fields(routes))
+		if err != nil {
+			return opts, err
+		}
 	}
-	for k, vs := range req.Headers {
-		for _, v := range vs {
-			r.Header.Add(k, v)
+
+	if tcp != "" {
+		opts.TCP, err = parseTCP(strings.Fields(tcp))
+		if err != nil {
+			return opts, err
 		}
 	}
 
-	res, err := (&http.Client{Timeout: requestTimeout}).Do(r)
+	opts.MaxRequestBody, err = tun.ParseSize(p.lookup("TUN_MAX_REQUEST_BODY"))
 	if err != nil {
-		log.Printf("local request error: %v", err)
-		resp.Status = http.StatusBadGateway
-		resp.Body = []byte(err.Error())
-		c.send(resp)
-		return
+		return opts, fmt.Errorf("invalid TUN_MAX_REQUEST_BODY: %w", err)
 	}
-	defer res.Body.Close()
-
-	resp.Status = res.StatusCode
-	resp.Headers = map[string][]string(res.Header)
-	resp.Body, err = io.ReadAll(res.Body)
+	opts.MaxResponseBody, err = tun.ParseSize(p.lookup("TUN_MAX_RESPONSE_BODY"))
 	if err != nil {
-		log.Printf("read body error: %v", err)
-		resp.Status = http.StatusBadGateway
-		resp.Body = []byte(err.Error())
+		return opts, fmt.Errorf("invalid TUN_MAX_RESPONSE_BODY: %w", err)
 	}
-	c.send(resp)
-}
 
-func (c *client) send(resp tun.Response) {
-	msg, err := json.Marshal(resp)
+	// tund enforces the IP filter; check it here to fail fast.
+	opts.IPAllow, err = tun.ParsePrefixes(p.lookup("TUN_IP_ALLOW"))
 	if err != nil {
-		log.Printf("marshal error: %v", err)
-		return
+		return opts, fmt.Errorf("invalid TUN_IP_ALLOW: %w", err)
 	}
-	c.mu.Lock()
-	err = c.conn.WriteMessage(websocket.TextMessage, msg)
-	c.mu.Unlock()
+	opts.IPDeny, err = tun.ParsePrefixes(p.lookup("TUN_IP_DENY"))
 	if err != nil {
-		log.Printf("write error: %v", err)
+		return opts, fmt.Errorf("invalid TUN_IP_DENY: %w", err)
 	}
+
+	opts.PublicAuth = p.lookup("TUN_PUBLIC_AUTH")
+	opts.PublicToken = p.lookup("TUN_PUBLIC_TOKEN")
+	if u, pass, ok := strings.Cut(opts.PublicAuth, ":"); opts.PublicAuth != "" && (!ok || u == "" || pass == "") {
+		return opts, errors.New(`invalid TUN_PUBLIC_AUTH: want "user:pass"`)
+	}
+
+	if opts.Handler == nil {
+		targets := []string{opts.Local}
+		for _, r := range opts.Routes {
+			targets = append(targets, r.Target)
+		}
+		local := tlsOptions{
+			caFile:   p.lookup("TUN_LOCAL_CA"),
+			insecure: p.lookup("TUN_LOCAL_INSECURE") == "1",
+		}
+		opts.LocalTLS, err = local.config(targets)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	if v := p.lookup("TUN_SHUTDOWN_TIMEOUT"); v != "" {
+		opts.DrainTimeout, err = time.ParseDuration(v)
+		if err != nil || opts.DrainTimeout < 0 {
+			return opts, fmt.Errorf("invalid TUN_SHUTDOWN_TIMEOUT %q: want a duration such as 30s", v)
+		}
+		if opts.DrainTimeout == 0 {
+			opts.DrainTimeout = -1 // don't wait; zero means the default to tun.Client
+		}
+	}
+	return opts, nil
 }
 
-func parseRules(args []string) ([]rule, error) {
+func parseRules(args []string) ([]tun.Rule, error) {
 	if len(args) == 0 || len(args)%2 != 0 {
 		return nil, fmt.Errorf("TUN_ALLOW requires METHOD /path pairs")
 	}
-	var rules []rule
+	var rules []tun.Rule
 	for i := 0; i < len(args); i += 2 {
-		rules = append(rules, rule{
-			method: strings.ToUpper(args[i]),
-			path:   args[i+1],
+		rules = append(rules, tun.Rule{
+			Method: strings.ToUpper(args[i]),
+			Path:   args[i+1],
 		})
 	}
 	return rules, nil
 }
 
-func allowed(rules []rule, method, path string) bool {
-	for _, r := range rules {
-		if r.method == method && r.path == path {
-			return true
+func parseRoutes(args []string) ([]tun.Route, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, fmt.Errorf("TUN_ROUTES requires /prefix URL pairs")
+	}
+	var routes []tun.Route
+	for i := 0; i < len(args); i += 2 {
+		prefix, target := args[i], args[i+1]
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("TUN_ROUTES prefix %q must start with /", prefix)
 		}
+		if _, err := url.ParseRequestURI(target); err != nil {
+			return nil, fmt.Errorf("TUN_ROUTES target %q: %w", target, err)
+		}
+		routes = append(routes, tun.Route{
+			Prefix: strings.TrimSuffix(prefix, "/"),
+			Target: strings.TrimSuffix(target, "/"),
+		})
 	}
-	return false
+	return routes, nil
 }
 
 // getUser returns the tunnel user identifier.
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/croaky/tun"
 )
 
 func TestParseRules(t *testing.T) {
@@ -39,29 +50,101 @@ func TestParseRules(t *testing.T) {
 	}
 }
 
-func TestAllowed(t *testing.T) {
-	rules, _ := parseRules([]string{"POST", "/slack/events", "GET", "/health"})
-
+func TestParseRoutes(t *testing.T) {
 	tests := []struct {
-		method string
-		path   string
-		want   bool
+		name    string
+		args    []string
+		wantErr bool
+		wantLen int
 	}{
-		{"POST", "/slack/events", true},
-		{"GET", "/health", true},
-		{"GET", "/slack/events", false},
-		{"POST", "/health", false},
-		{"POST", "/other", false},
-		{"DELETE", "/slack/events", false},
-		{"POST", "/slack/events/", false},
-		{"POST", "/Slack/Events", false},
+		{"valid single", []string{"/webhooks", "http://localhost:4000"}, false, 1},
+		{"valid multiple", []string{"/api", "http://localhost:3000", "/webhooks", "http://localhost:4000"}, false, 2},
+		{"empty", []string{}, true, 0},
+		{"odd count", []string{"/api"}, true, 0},
+		{"prefix without slash", []string{"api", "http://localhost:3000"}, true, 0},
+		{"invalid target", []string{"/api", "localhost"}, true, 0},
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
-			if got := allowed(rules, tt.method, tt.path); got != tt.want {
-				t.Errorf("allowed(%q, %q) = %v, want %v", tt.method, tt.path, got, tt.want)
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := parseRoutes(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if got := len(routes); got != tt.wantLen {
+				t.Errorf("got %d routes, want %d", got, tt.wantLen)
 			}
 		})
 	}
 }
+
+func TestStartSharedServer(t *testing.T) {
+	discard := slog.New(slog.DiscardHandler)
+	disconnected := make(chan tun.TunnelInfo, 1)
+	s, err := tun.NewServer(tun.ServerOptions{
+		Authenticator: tun.TokenAuth("secret"),
+		Logger:        discard,
+		OnDisconnect: func(ti tun.TunnelInfo) {
+			select {
+			case disconnected <- ti:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	server := "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel"
+	var config strings.Builder
+	for _, name := range []string{"slack", "stripe"} {
+		fmt.Fprintf(&config, "[%s]\nserver = %q\nlocal = \"http://127.0.0.1:1\"\nallow = [\"GET /\"]\ntoken = \"secret\"\n", name, server)
+	}
+	file := filepath.Join(t.TempDir(), "tun.toml")
+	if err := os.WriteFile(file, []byte(config.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"TUN_SERVER", "TUN_LOCAL", "TUN_ALLOW", "TUN_TOKEN"} {
+		t.Setenv(k, "")
+	}
+
+	if _, err := selectProfiles(file, []string{"--all"}); err == nil {
+		t.Error("profiles sharing a server: want error")
+	}
+
+	// Run together anyway, each profile's connection closes the other's.
+	profiles, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, p := range profiles {
+		opts, err := clientOptions(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Logger = discard
+		c, err := tun.NewClient(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Go(func() { _ = c.Run(ctx) })
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Error("two profiles on one server both stayed connected")
+	}
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// fixture is a recorded response served in playback mode.
+// Body is a string rather than []byte so fixture files stay hand-editable,
+// unless Encoding is "base64", as record mode saves bodies that are not
+// UTF-8 text. If Template is set, Body is a text/template executed with
+// the request.
+type fixture struct {
+	Method   string              `json:"method"`
+	Path     string              `json:"path"`
+	Status   int                 `json:"status"`
+	Headers  map[string][]string `json:"headers,omitempty"`
+	Body     string              `json:"body"`
+	Encoding string              `json:"encoding,omitempty"`
+	Template bool                `json:"template,omitempty"`
+
+	tmpl *template.Template
+}
+
+// templateRequest is the data for a fixture body template.
+type templateRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+	JSON   any // Body parsed as JSON, or nil
+}
+
+var templateFuncs = template.FuncMap{
+	// json encodes v, such as to echo a request field into a JSON body.
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// loadFixtures reads a JSON array of fixtures from name.
+func loadFixtures(name string) ([]fixture, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	for i, f := range fixtures {
+		if f.Method == "" || f.Path == "" {
+			return nil, fmt.Errorf("parse %s: fixture %d requires method and path", name, i)
+		}
+		fixtures[i].Method = strings.ToUpper(f.Method)
+		if f.Status == 0 {
+			fixtures[i].Status = http.StatusOK
+		}
+		switch f.Encoding {
+		case "":
+		case "base64":
+			if f.Template {
+				return nil, fmt.Errorf("parse %s: fixture %d: a template body can't be base64", name, i)
+			}
+			if _, err := base64.StdEncoding.DecodeString(f.Body); err != nil {
+				return nil, fmt.Errorf("parse %s: fixture %d: %w", name, i, err)
+			}
+		default:
+			return nil, fmt.Errorf("parse %s: fixture %d: unknown encoding %q", name, i, f.Encoding)
+		}
+		if f.Template {
+			fixtures[i].tmpl, err = template.New(f.Path).Funcs(templateFuncs).Parse(f.Body)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: fixture %d: %w", name, i, err)
+			}
+		}
+	}
+	return fixtures, nil
+}
+
+// playback answers requests from the first fixture matching their
+// method and path, including any query. Matching is exact, like TUN_ALLOW rules.
+type playback []fixture
+
+func (p playback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.RequestURI()
+	for _, f := range p {
+		if f.Method == r.Method && f.Path == path {
+			body := []byte(f.Body)
+			if f.Encoding == "base64" {
+				body, _ = base64.StdEncoding.DecodeString(f.Body) // checked by loadFixtures
+			}
+			if f.tmpl != nil {
+				var err error
+				if body, err = render(f.tmpl, r); err != nil {
+					http.Error(w, "playback template error: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			for k, vs := range f.Headers {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(f.Status)
+			_, _ = w.Write(body)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write([]byte("no playback fixture"))
+}
+
+// render executes a fixture body template with r.
+func render(tmpl *template.Template, r *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	data := templateRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+		Body:   string(b),
+	}
+	_ = json.Unmarshal(b, &data.JSON)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
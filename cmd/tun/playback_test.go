@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadFixtures(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+		wantLen int
+	}{
+		{"valid", `[{"method":"post","path":"/slack/events","body":"{}"}]`, false, 1},
+		{"empty array", `[]`, false, 0},
+		{"missing path", `[{"method":"POST"}]`, true, 0},
+		{"missing method", `[{"path":"/slack/events"}]`, true, 0},
+		{"invalid json", `{`, true, 0},
+		{"invalid template", `[{"method":"POST","path":"/a","body":"{{.Body","template":true}]`, true, 0},
+		{"base64", `[{"method":"GET","path":"/a","body":"AP8=","encoding":"base64"}]`, false, 1},
+		{"invalid base64", `[{"method":"GET","path":"/a","body":"not base64!","encoding":"base64"}]`, true, 0},
+		{"base64 template", `[{"method":"GET","path":"/a","body":"AP8=","encoding":"base64","template":true}]`, true, 0},
+		{"unknown encoding", `[{"method":"GET","path":"/a","body":"","encoding":"hex"}]`, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fixtures.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fixtures, err := loadFixtures(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := len(fixtures); got != tt.wantLen {
+				t.Errorf("got %d fixtures, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestLoadFixtures_Defaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.json")
+	if err := os.WriteFile(path, []byte(`[{"method":"post","path":"/slack/events"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures, err := loadFixtures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fixtures[0].Method; got != "POST" {
+		t.Errorf("method = %q, want POST", got)
+	}
+	if got := fixtures[0].Status; got != http.StatusOK {
+		t.Errorf("status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	fixtures := []fixture{
+		{
+			Method:  "POST",
+			Path:    "/slack/events",
+			Status:  http.StatusOK,
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    `{"ok":true}`,
+		},
+		{Method: "GET", Path: "/health", Status: http.StatusNoContent},
+	}
+
+	tests := []struct {
+		method, path string
+		wantStatus   int
+		wantBody     string
+	}{
+		{"POST", "/slack/events", http.StatusOK, `{"ok":true}`},
+		{"GET", "/health", http.StatusNoContent, ""},
+		{"GET", "/slack/events", http.StatusNotFound, "no playback fixture"},
+		{"POST", "/slack/events?retry=1", http.StatusNotFound, "no playback fixture"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			playback(fixtures).ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if body := w.Body.String(); body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestPlayback_Template(t *testing.T) {
+	// Slack's URL verification requires echoing the request's challenge.
+	path := filepath.Join(t.TempDir(), "fixtures.json")
+	content := `[{
+		"method": "POST",
+		"path": "/slack/events",
+		"template": true,
+		"body": "{{if eq .JSON.type \"url_verification\"}}{\"challenge\":{{json .JSON.challenge}}}{{else}}{\"ok\":true}{{end}}"
+	}, {
+		"method": "GET",
+		"path": "/echo?q=hi",
+		"template": true,
+		"body": "{{.Method}} {{.Query.Get \"q\"}}{{.JSON.missing}}"
+	}]`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fixtures, err := loadFixtures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, body string
+		wantStatus         int
+		wantBody           string
+	}{
+		{"POST", "/slack/events", `{"type":"url_verification","challenge":"abc"}`, http.StatusOK, `{"challenge":"abc"}`},
+		{"POST", "/slack/events", `{"type":"event_callback"}`, http.StatusOK, `{"ok":true}`},
+		{"GET", "/echo?q=hi", "", http.StatusInternalServerError, "playback template error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			playback(fixtures).ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if body := w.Body.String(); !strings.HasPrefix(body, tt.wantBody) {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
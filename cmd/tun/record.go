@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/croaky/tun"
+)
+
+// skipHeaders are response headers not worth recording:
+// they describe one response rather than the fixture.
+var skipHeaders = []string{"Content-Length", "Date", "Connection", "Keep-Alive", "Transfer-Encoding"}
+
+// recorder forwards requests to a local service and saves each
+// response as a fixture for playback mode.
+type recorder struct {
+	file  string
+	proxy http.Handler
+
+	mu       sync.Mutex
+	fixtures []fixture
+}
+
+// newRecorder returns a recorder forwarding to local, an http://,
+// https://, or unix:// URL, and saving fixtures to file.
+// Fixtures already in file are kept unless a request replaces them.
+func newRecorder(file, local string, tlsCfg *tls.Config) (*recorder, error) {
+	tr, u, err := tun.LocalTransport(local, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recorder{file: file}
+	if _, err := os.Stat(file); err == nil {
+		if rec.fixtures, err = loadFixtures(file); err != nil {
+			return nil, err
+		}
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// Send the local service's own Host, as normal mode does,
+		// rather than the tunnel's in-process one.
+		r.Host = u.Host
+	}
+	proxy.Transport = tr
+	proxy.ModifyResponse = rec.save
+	rec.proxy = proxy
+	return rec, nil
+}
+
+// pathKey carries the request's path and query, as tund received it,
+// to save.
+type pathKey struct{}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), pathKey{}, r.URL.RequestURI())
+	rec.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// save records res, replacing any fixture for the same method and path,
+// and rewrites the fixtures file so it is complete if tun is stopped.
+// Failing to save is logged; the response is still returned.
+func (rec *recorder) save(res *http.Response) error {
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(res.Body); err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body.Bytes()))
+
+	header := res.Header.Clone()
+	for _, k := range skipHeaders {
+		header.Del(k)
+	}
+	f := fixture{
+		Method:  res.Request.Method,
+		Path:    res.Request.Context().Value(pathKey{}).(string),
+		Status:  res.StatusCode,
+		Headers: header,
+		Body:    body.String(),
+	}
+	// Keep text bodies readable; JSON strings would mangle binary ones.
+	if !utf8.Valid(body.Bytes()) {
+		f.Body = base64.StdEncoding.EncodeToString(body.Bytes())
+		f.Encoding = "base64"
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	replaced := false
+	for i, old := range rec.fixtures {
+		if old.Method == f.Method && old.Path == f.Path {
+			rec.fixtures[i] = f
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		rec.fixtures = append(rec.fixtures, f)
+	}
+	data, err := json.MarshalIndent(rec.fixtures, "", "  ")
+	if err == nil {
+		err = os.WriteFile(rec.file, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		slog.Error("record error", "err", err, "file", rec.file)
+	}
+	return nil
+}
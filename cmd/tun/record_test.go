@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	n := 0
+	var host string
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		host = r.Host
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"n":` + strconv.Itoa(n) + `}`))
+	}))
+	t.Cleanup(local.Close)
+
+	file := filepath.Join(t.TempDir(), "fixtures.json")
+	rec, err := newRecorder(file, local.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path string) string {
+		w := httptest.NewRecorder()
+		rec.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader("{}")))
+		b, _ := io.ReadAll(w.Result().Body)
+		return string(b)
+	}
+	if got := do("POST", "/slack/events?x=1"); got != `{"n":1}` {
+		t.Errorf("forwarded body = %q", got)
+	}
+	if want := strings.TrimPrefix(local.URL, "http://"); host != want {
+		t.Errorf("local Host = %q, want %q", host, want)
+	}
+	do("GET", "/health")
+	do("POST", "/slack/events?x=1") // replaces the first fixture
+
+	fixtures, err := loadFixtures(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) != 2 {
+		t.Fatalf("got %d fixtures, want 2", len(fixtures))
+	}
+	f := fixtures[0]
+	if f.Method != "POST" || f.Path != "/slack/events?x=1" || f.Status != http.StatusCreated || f.Body != `{"n":3}` {
+		t.Errorf("fixture = %+v", f)
+	}
+	if got := http.Header(f.Headers); got.Get("Content-Type") != "application/json" || got.Get("Date") != "" {
+		t.Errorf("headers = %v, want Content-Type without Date", got)
+	}
+
+	// A new recorder keeps fixtures already saved.
+	rec, err = newRecorder(file, local.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.fixtures) != 2 {
+		t.Errorf("reloaded %d fixtures, want 2", len(rec.fixtures))
+	}
+
+	if _, err := newRecorder(file, "ftp://localhost", nil); err == nil {
+		t.Error("ftp target: want error")
+	}
+}
+
+func TestRecorderBinary(t *testing.T) {
+	data := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 0x00, '\n'}
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(local.Close)
+
+	file := filepath.Join(t.TempDir(), "fixtures.json")
+	rec, err := newRecorder(file, local.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/image", nil))
+
+	fixtures, err := loadFixtures(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) != 1 || fixtures[0].Encoding != "base64" {
+		t.Fatalf("fixtures = %+v, want one base64 fixture", fixtures)
+	}
+	w := httptest.NewRecorder()
+	playback(fixtures).ServeHTTP(w, httptest.NewRequest("GET", "/image", nil))
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("played back %x, want %x", w.Body.Bytes(), data)
+	}
+}
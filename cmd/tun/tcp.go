@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseTCP parses space-separated name=host:port pairs from TUN_TCP.
+func parseTCP(args []string) (map[string]string, error) {
+	tcp := make(map[string]string)
+	for _, arg := range args {
+		name, addr, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("TUN_TCP requires name=host:port pairs, got %q", arg)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("TUN_TCP %s: %w", name, err)
+		}
+		tcp[name] = addr
+	}
+	return tcp, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTCP(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		wantLen int
+	}{
+		{"valid single", []string{"pg=localhost:5432"}, false, 1},
+		{"valid multiple", []string{"pg=localhost:5432", "ssh=127.0.0.1:22"}, false, 2},
+		{"missing name", []string{"=localhost:5432"}, true, 0},
+		{"missing equals", []string{"localhost:5432"}, true, 0},
+		{"missing port", []string{"pg=localhost"}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp, err := parseTCP(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if got := len(tcp); got != tt.wantLen {
+				t.Errorf("got %d tunnels, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
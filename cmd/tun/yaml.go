@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseYAMLConfig parses the subset of YAML that tun.yaml uses,
+// with the same keys and values as tun.toml: a mapping of profile
+// names to mappings of keys to scalars or sequences of scalars,
+// and # comments. Sequences are block or [flow] style. Indentation
+// is spaces only.
+//
+//	slack:
+//	  server: wss://tun.example.com/tunnel
+//	  local: http://localhost:3000
+//	  allow:
+//	    - POST /slack/events
+//	    - GET /health
+//	  token_env: SLACK_TUN_TOKEN
+func parseYAMLConfig(r io.Reader) ([]profile, error) {
+	var profiles []profile
+	seen := map[string]bool{}
+	keyIndent, itemIndent := 0, 0
+	var listKey string // a key whose block sequence is being read
+	var items []string
+	var listLine int
+
+	// endList stores the sequence being read, if any.
+	endList := func() error {
+		if listKey == "" {
+			return nil
+		}
+		if len(items) == 0 {
+			return fmt.Errorf("line %d: %s: want a value", listLine, listKey)
+		}
+		err := setVar(profiles[len(profiles)-1].vars, listKey, strings.Join(items, " "))
+		listKey, items, itemIndent = "", nil, 0
+		if err != nil {
+			return fmt.Errorf("line %d: %w", listLine, err)
+		}
+		return nil
+	}
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimRight(sc.Text(), " \t\r")
+		line := strings.TrimLeft(text, " ")
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", n)
+		}
+		indent := len(text) - len(line)
+
+		if listKey != "" && (line == "-" || strings.HasPrefix(line, "- ")) {
+			if itemIndent == 0 {
+				itemIndent = indent
+			}
+			if indent != itemIndent || indent < keyIndent {
+				return nil, fmt.Errorf("line %d: misaligned sequence item", n)
+			}
+			v, err := parseYAMLScalar(strings.TrimSpace(line[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s: %w", n, listKey, err)
+			}
+			items = append(items, v)
+			continue
+		}
+		if err := endList(); err != nil {
+			return nil, err
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || !validName(k) || v != "" && v[0] != ' ' {
+			return nil, fmt.Errorf("line %d: want key: value", n)
+		}
+		v = strings.TrimSpace(v)
+
+		if indent == 0 {
+			if !isComment(v) {
+				return nil, fmt.Errorf("line %d: want a mapping for profile %s", n, k)
+			}
+			if seen[k] {
+				return nil, fmt.Errorf("line %d: duplicate profile %q", n, k)
+			}
+			seen[k] = true
+			profiles = append(profiles, profile{name: k, vars: map[string]string{}})
+			keyIndent = 0
+			continue
+		}
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("line %d: %s outside a profile", n, k)
+		}
+		if keyIndent == 0 {
+			keyIndent = indent
+		}
+		if indent != keyIndent {
+			return nil, fmt.Errorf("line %d: misaligned key %s", n, k)
+		}
+
+		if isComment(v) {
+			listKey, listLine = k, n
+			continue
+		}
+		var val string
+		var err error
+		if strings.HasPrefix(v, "[") {
+			val, err = parseYAMLFlow(v)
+		} else {
+			val, err = parseYAMLScalar(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, k, err)
+		}
+		if err := setVar(profiles[len(profiles)-1].vars, k, val); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := endList(); err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no profiles")
+	}
+	return profiles, nil
+}
+
+// parseYAMLScalar parses a scalar followed by an optional comment.
+// Plain true is "1" and false is "", as in tun.toml.
+func parseYAMLScalar(s string) (string, error) {
+	v, rest, quoted, err := yamlScalar(s, false)
+	if err != nil {
+		return "", err
+	}
+	if !isComment(rest) {
+		return "", fmt.Errorf("unexpected text after value")
+	}
+	if !quoted {
+		switch v {
+		case "true":
+			return "1", nil
+		case "false":
+			return "", nil
+		}
+	}
+	return v, nil
+}
+
+// parseYAMLFlow parses a [flow, sequence] of scalars,
+// followed by an optional comment, and joins them with spaces.
+func parseYAMLFlow(s string) (string, error) {
+	var items []string
+	rest := strings.TrimSpace(s[1:])
+	for !strings.HasPrefix(rest, "]") {
+		item, r, _, err := yamlScalar(rest, true)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, item)
+		rest = strings.TrimSpace(r)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return "", fmt.Errorf("want , or ] in sequence")
+		}
+	}
+	if !isComment(rest[1:]) {
+		return "", fmt.Errorf("unexpected text after value")
+	}
+	return strings.Join(items, " "), nil
+}
+
+// yamlScalar parses a leading "double-quoted", 'single-quoted',
+// or plain scalar and returns it with the text after it.
+// In a flow sequence, plain scalars end at , or ].
+func yamlScalar(s string, flow bool) (v, rest string, quoted bool, err error) {
+	switch {
+	case s == "":
+		return "", "", false, fmt.Errorf("want a value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", false, fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return v, s[i+1:], true, nil
+			}
+		}
+		return "", "", false, fmt.Errorf("unterminated string")
+	case s[0] == '\'':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return b.String(), s[i+1:], true, nil
+		}
+		return "", "", false, fmt.Errorf("unterminated string")
+	case strings.ContainsRune("[]{}&*!|>%@`", rune(s[0])):
+		return "", "", false, fmt.Errorf("unsupported value %s", s)
+	}
+	end := len(s)
+	if i := strings.Index(s, " #"); i >= 0 {
+		end = i
+	}
+	if flow {
+		if i := strings.IndexAny(s[:end], ",]"); i >= 0 {
+			end = i
+		}
+	}
+	v = strings.TrimSpace(s[:end])
+	if v == "" {
+		return "", "", false, fmt.Errorf("want a value")
+	}
+	return v, s[end:], false, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testYAML holds the profiles of testConfig.
+const testYAML = `
+# Webhook tunnels
+slack:
+  server: wss://tun.example.com/tunnel
+  local: "http://localhost:3000" # the Rails app
+  allow:
+    - POST /slack/events
+    - GET /health
+  token_env: SLACK_TUN_TOKEN
+
+stripe:
+  server: 'wss://stripe.tun.example.com/tunnel'
+  routes: [ /webhooks http://localhost:4000 ]
+  allow:
+  - "POST /webhooks/stripe"
+  local-insecure: true
+  public_auth: 'user:p"ss'
+`
+
+func TestParseYAMLConfig(t *testing.T) {
+	got, err := parseYAMLConfig(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := parseConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseYAMLConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"empty", "# nothing\n"},
+		{"key outside profile", "  server: ws://tund\n"},
+		{"profile value", "slack: ws://tund\n"},
+		{"nested mapping", "tun:\n  slack:\n    local: a\n"},
+		{"duplicate profile", "slack:\nslack:\n"},
+		{"duplicate key", "slack:\n  local: a\n  local: b\n"},
+		{"missing colon", "slack:\n  local\n"},
+		{"misaligned key", "slack:\n  local: a\n    allow: b\n"},
+		{"misaligned item", "slack:\n  allow:\n    - POST /a\n      - GET /b\n"},
+		{"empty sequence", "slack:\n  allow:\n"},
+		{"tab indent", "slack:\n\tlocal: a\n"},
+		{"unterminated string", "slack:\n  local: \"http://localhost\n"},
+		{"unterminated sequence", "slack:\n  allow: [POST /a\n"},
+		{"trailing text", "slack:\n  local: \"a\" b\n"},
+		{"mapping value", "slack:\n  local: {a: b}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseYAMLConfig(strings.NewReader(tt.config)); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ACME renewal timing. Certificates are renewed when they have less than
+// renewBefore left. Failed attempts are retried after acmeRetry, doubling
+// with each failure up to acmeRetryMax, so a misconfigured domain stays
+// under the CA's failed validation rate limit (5 per hour at Let's Encrypt).
+// Each attempt is abandoned after acmeTimeout, so a stalled CA or
+// DNS hook can't hold up renewal forever.
+const (
+	renewBefore  = 30 * 24 * time.Hour
+	acmeCheck    = 12 * time.Hour
+	acmeRetry    = 10 * time.Minute
+	acmeRetryMax = 6 * time.Hour
+	acmeTimeout  = 10 * time.Minute
+)
+
+// solver completes one type of ACME challenge.
+type solver interface {
+	// Type is the ACME challenge type, "http-01" or "dns-01".
+	Type() string
+
+	// Present makes the challenge response visible to the CA. For http-01,
+	// value is the key authorization to serve at the token's path; for
+	// dns-01, it is the TXT record value for _acme-challenge.<domain>.
+	Present(ctx context.Context, domain, token, value string) error
+
+	// CleanUp removes what Present added.
+	CleanUp(ctx context.Context, domain, token, value string) error
+}
+
+// A solver that serves challenges itself implements listener,
+// so that it only listens while an order is in progress.
+type listener interface {
+	// listen starts serving challenges and returns a function
+	// that stops.
+	listen() (stop func(), err error)
+}
+
+// newACMEFromEnv configures ACME from the TUN_ACME_* variables.
+// Unless TUN_ACME_DNS_HOOK selects dns-01, it answers http-01
+// challenges on TUN_ACME_HTTP_PORT.
+func newACMEFromEnv(domains []string) (*acmeManager, error) {
+	directory := strings.TrimSpace(os.Getenv("TUN_ACME_DIRECTORY"))
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+	cache := strings.TrimSpace(os.Getenv("TUN_ACME_CACHE"))
+	if cache == "" {
+		cache = "acme"
+	}
+
+	// A private CA, such as a local test server, may need its own root.
+	httpClient := http.DefaultClient
+	if name := strings.TrimSpace(os.Getenv("TUN_ACME_CA")); name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", name)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+		httpClient = &http.Client{Transport: tr}
+	}
+
+	var s solver
+	if hook := strings.TrimSpace(os.Getenv("TUN_ACME_DNS_HOOK")); hook != "" {
+		s = dnsHook{path: hook}
+	} else {
+		port := strings.TrimSpace(os.Getenv("TUN_ACME_HTTP_PORT"))
+		if port == "" {
+			port = "80"
+		}
+		s = &httpSolver{addr: ":" + port}
+	}
+
+	return newACMEManager(directory, httpClient, domains, strings.TrimSpace(os.Getenv("TUN_ACME_EMAIL")), cache, s)
+}
+
+// acmeManager obtains and renews a certificate covering domains,
+// caching it and the account key on disk.
+type acmeManager struct {
+	client  *acme.Client
+	domains []string
+	email   string
+	cache   string // directory
+	solver  solver
+	timeout time.Duration // for each attempt
+
+	registered bool
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newACMEManager loads or creates the account key in cache and
+// loads a cached certificate if there is one.
+func newACMEManager(directory string, httpClient *http.Client, domains []string, email, cache string, s solver) (*acmeManager, error) {
+	if err := os.MkdirAll(cache, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateKey(filepath.Join(cache, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	m := &acmeManager{
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: directory,
+			HTTPClient:   httpClient,
+			UserAgent:    "tund",
+		},
+		domains: domains,
+		email:   email,
+		cache:   cache,
+		solver:  s,
+		timeout: acmeTimeout,
+	}
+
+	data, err := os.ReadFile(m.certFile())
+	if err == nil {
+		cert, err := tls.X509KeyPair(data, data)
+		if err != nil {
+			slog.Error("acme cache error", "err", err)
+		} else {
+			m.cert = &cert
+		}
+	}
+	return m, nil
+}
+
+func (m *acmeManager) certFile() string {
+	return filepath.Join(m.cache, "cert.pem")
+}
+
+// getCertificate serves the current certificate for every server name.
+func (m *acmeManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acme: certificate not ready")
+	}
+	return m.cert, nil
+}
+
+// run keeps the certificate current until ctx is done.
+func (m *acmeManager) run(ctx context.Context) {
+	failures := 0
+	for {
+		wait := acmeCheck
+		if err := m.renew(ctx); err != nil {
+			failures++
+			wait = retryDelay(failures)
+			slog.Error("acme error", "err", err, "retry_in", wait)
+		} else {
+			failures = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryDelay returns how long to wait after the given number of
+// consecutive failures.
+func retryDelay(failures int) time.Duration {
+	d := acmeRetry
+	for range failures - 1 {
+		d *= 2
+		if d >= acmeRetryMax {
+			return acmeRetryMax
+		}
+	}
+	return d
+}
+
+// renew obtains a new certificate if the current one is missing,
+// expiring, or doesn't cover every domain.
+func (m *acmeManager) renew(ctx context.Context) error {
+	if !m.needsRenewal(time.Now()) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	cert, err := m.obtain(ctx)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	slog.Info("acme certificate issued",
+		"domains", strings.Join(m.domains, " "),
+		"not_after", cert.Leaf.NotAfter.Format(time.DateOnly),
+	)
+	return nil
+}
+
+func (m *acmeManager) needsRenewal(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil {
+		return true
+	}
+	leaf := m.cert.Leaf
+	if now.Add(renewBefore).After(leaf.NotAfter) {
+		return true
+	}
+	for _, d := range m.domains {
+		if !slices.Contains(leaf.DNSNames, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// obtain runs an ACME order for m.domains and caches the result.
+func (m *acmeManager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	if !m.registered {
+		acct := &acme.Account{}
+		if m.email != "" {
+			acct.Contact = []string{"mailto:" + m.email}
+		}
+		_, err := m.client.Register(ctx, acct, acme.AcceptTOS)
+		if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+			return nil, fmt.Errorf("register: %w", err)
+		}
+		m.registered = true
+	}
+
+	order, err := m.authorizeOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.domains}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, b := range der {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := os.WriteFile(m.certFile(), data, 0o600); err != nil {
+		slog.Error("acme cache error", "err", err)
+	}
+	return &cert, nil
+}
+
+// authorizeOrder creates an order for m.domains and waits until the
+// CA has validated each of them. A solver that listens for challenges
+// does so only until the order is ready or fails.
+func (m *acmeManager) authorizeOrder(ctx context.Context) (*acme.Order, error) {
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return nil, fmt.Errorf("order: %w", err)
+	}
+	if l, ok := m.solver.(listener); ok {
+		stop, err := l.listen()
+		if err != nil {
+			return nil, fmt.Errorf("%s listener: %w", m.solver.Type(), err)
+		}
+		defer stop()
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("order: %w", err)
+	}
+	return order, nil
+}
+
+// authorize completes the solver's challenge for one authorization.
+func (m *acmeManager) authorize(ctx context.Context, url string) error {
+	z, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	domain := z.Identifier.Value
+
+	i := slices.IndexFunc(z.Challenges, func(c *acme.Challenge) bool { return c.Type == m.solver.Type() })
+	if i < 0 {
+		return fmt.Errorf("%s: CA offered no %s challenge", domain, m.solver.Type())
+	}
+	chal := z.Challenges[i]
+
+	var value string
+	switch chal.Type {
+	case "http-01":
+		value, err = m.client.HTTP01ChallengeResponse(chal.Token)
+	case "dns-01":
+		value, err = m.client.DNS01ChallengeRecord(chal.Token)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.solver.Present(ctx, domain, chal.Token, value); err != nil {
+		return fmt.Errorf("%s: present %s: %w", domain, chal.Type, err)
+	}
+	defer func() {
+		if err := m.solver.CleanUp(ctx, domain, chal.Token, value); err != nil {
+			slog.Error("acme cleanup error", "err", err)
+		}
+	}()
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("%s: accept %s: %w", domain, chal.Type, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("%s: %w", domain, err)
+	}
+	return nil
+}
+
+// loadOrCreateKey reads a PEM EC private key, creating it if missing.
+func loadOrCreateKey(name string) (crypto.Signer, error) {
+	data, err := os.ReadFile(name)
+	if err == nil {
+		b, _ := pem.Decode(data)
+		if b == nil {
+			return nil, fmt.Errorf("%s: no PEM data", name)
+		}
+		return x509.ParseECPrivateKey(b.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// httpSolver answers http-01 challenges and redirects
+// all other requests to HTTPS.
+type httpSolver struct {
+	addr string // to listen on; empty if served elsewhere
+
+	mu     sync.Mutex
+	tokens map[string]string // token to key authorization
+}
+
+func (h *httpSolver) Type() string { return "http-01" }
+
+func (h *httpSolver) listen() (func(), error) {
+	if h.addr == "" {
+		return func() {}, nil
+	}
+	ln, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("acme http-01 listener error", "err", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
+
+func (h *httpSolver) Present(_ context.Context, _, token, value string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens == nil {
+		h.tokens = make(map[string]string)
+	}
+	h.tokens[token] = value
+	return nil
+}
+
+func (h *httpSolver) CleanUp(_ context.Context, _, token, _ string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.tokens, token)
+	return nil
+}
+
+func (h *httpSolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/.well-known/acme-challenge/"
+	if token, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+		h.mu.Lock()
+		value, ok := h.tokens[token]
+		h.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(value))
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "use https", http.StatusBadRequest)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// dnsHook answers dns-01 challenges by running an executable:
+//
+//	hook present <domain> <record name> <value>
+//	hook cleanup <domain> <record name> <value>
+//
+// The hook should return once the TXT record is visible to the CA.
+type dnsHook struct {
+	path string
+}
+
+func (d dnsHook) Type() string { return "dns-01" }
+
+func (d dnsHook) Present(ctx context.Context, domain, _, value string) error {
+	return d.run(ctx, "present", domain, value)
+}
+
+func (d dnsHook) CleanUp(ctx context.Context, domain, _, value string) error {
+	return d.run(ctx, "cleanup", domain, value)
+}
+
+func (d dnsHook) run(ctx context.Context, action, domain, value string) error {
+	name := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+	out, err := exec.CommandContext(ctx, d.path, action, domain, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", d.path, action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeCA is a minimal RFC 8555 server. It skips JWS verification but
+// validates challenges for real: http-01 by fetching the token from
+// httpAddr, dns-01 by asking lookupTXT.
+type fakeCA struct {
+	t         *testing.T
+	srv       *httptest.Server
+	caKey     *ecdsa.PrivateKey
+	caCert    *x509.Certificate
+	thumb     string // account key thumbprint, for key authorizations
+	httpAddr  string
+	lookupTXT func(name string) string
+
+	mu     sync.Mutex
+	authzs []*fakeAuthz
+	ids    []string // order identifiers
+	certPE []byte
+}
+
+type fakeAuthz struct {
+	domain string
+	status string
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+	ca := &fakeCA{t: t}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caKey = key
+	ca.caCert, _ = x509.ParseCertificate(der)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", ca.directory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/account", ca.account)
+	mux.HandleFunc("/order", ca.newOrder)
+	mux.HandleFunc("/order/1", ca.order)
+	mux.HandleFunc("/authz/{i}", ca.authz)
+	mux.HandleFunc("/chal/{i}/{type}", ca.challenge)
+	mux.HandleFunc("/finalize", ca.finalize)
+	mux.HandleFunc("/cert", func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(ca.certPE)
+	})
+	ca.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		w.Header().Set("Cache-Control", "no-store")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string { return ca.srv.URL + path }
+
+// payload decodes a JWS request body's payload into v, if non-nil.
+func (ca *fakeCA) payload(r *http.Request, v any) {
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		ca.t.Errorf("decode JWS: %v", err)
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		ca.t.Errorf("decode payload: %v", err)
+		return
+	}
+	if v != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, v); err != nil {
+			ca.t.Errorf("decode payload %s: %v", b, err)
+		}
+	}
+}
+
+func writeJSON201(w http.ResponseWriter, location string, v any) {
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (ca *fakeCA) directory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"newNonce":   ca.url("/nonce"),
+		"newAccount": ca.url("/account"),
+		"newOrder":   ca.url("/order"),
+		"revokeCert": ca.url("/revoke"),
+		"keyChange":  ca.url("/keychange"),
+	})
+}
+
+func (ca *fakeCA) account(w http.ResponseWriter, r *http.Request) {
+	ca.payload(r, nil)
+	writeJSON201(w, ca.url("/account/1"), map[string]string{"status": "valid"})
+}
+
+func (ca *fakeCA) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Type, Value string }
+	}
+	ca.payload(r, &req)
+
+	ca.mu.Lock()
+	ca.authzs = nil
+	ca.ids = nil
+	for _, id := range req.Identifiers {
+		ca.authzs = append(ca.authzs, &fakeAuthz{domain: id.Value, status: "pending"})
+		ca.ids = append(ca.ids, id.Value)
+	}
+	ca.mu.Unlock()
+	writeJSON201(w, ca.url("/order/1"), ca.orderJSON())
+}
+
+func (ca *fakeCA) orderJSON() map[string]any {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	status := "ready"
+	var urls []string
+	var ids []map[string]string
+	for i, z := range ca.authzs {
+		if z.status != "valid" {
+			status = "pending"
+		}
+		urls = append(urls, ca.url(fmt.Sprintf("/authz/%d", i)))
+		ids = append(ids, map[string]string{"type": "dns", "value": z.domain})
+	}
+	o := map[string]any{
+		"status":         status,
+		"identifiers":    ids,
+		"authorizations": urls,
+		"finalize":       ca.url("/finalize"),
+	}
+	if ca.certPE != nil {
+		o["status"] = "valid"
+		o["certificate"] = ca.url("/cert")
+	}
+	return o
+}
+
+func (ca *fakeCA) order(w http.ResponseWriter, r *http.Request) {
+	ca.payload(r, nil)
+	w.Header().Set("Location", ca.url("/order/1"))
+	writeJSON(w, ca.orderJSON())
+}
+
+func (ca *fakeCA) authzJSON(i int) map[string]any {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	z := ca.authzs[i]
+	var chals []map[string]string
+	for _, typ := range []string{"http-01", "dns-01"} {
+		chals = append(chals, map[string]string{
+			"type":   typ,
+			"url":    ca.url(fmt.Sprintf("/chal/%d/%s", i, typ)),
+			"token":  fmt.Sprintf("token-%d", i),
+			"status": z.status,
+		})
+	}
+	return map[string]any{
+		"status":     z.status,
+		"identifier": map[string]string{"type": "dns", "value": z.domain},
+		"challenges": chals,
+		"expires":    time.Now().Add(time.Hour).Format(time.RFC3339),
+	}
+}
+
+func (ca *fakeCA) authz(w http.ResponseWriter, r *http.Request) {
+	ca.payload(r, nil)
+	var i int
+	fmt.Sscan(r.PathValue("i"), &i)
+	writeJSON(w, ca.authzJSON(i))
+}
+
+func (ca *fakeCA) challenge(w http.ResponseWriter, r *http.Request) {
+	ca.payload(r, nil)
+	var i int
+	fmt.Sscan(r.PathValue("i"), &i)
+	typ := r.PathValue("type")
+	token := fmt.Sprintf("token-%d", i)
+	keyAuth := token + "." + ca.thumb
+
+	ca.mu.Lock()
+	domain := ca.authzs[i].domain
+	ca.mu.Unlock()
+
+	valid := false
+	switch typ {
+	case "http-01":
+		res, err := http.Get("http://" + ca.httpAddr + "/.well-known/acme-challenge/" + token)
+		if err == nil {
+			b, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			valid = string(b) == keyAuth
+		}
+	case "dns-01":
+		sum := sha256.Sum256([]byte(keyAuth))
+		valid = ca.lookupTXT("_acme-challenge."+domain+".") == base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	status := "invalid"
+	if valid {
+		status = "valid"
+	}
+	ca.mu.Lock()
+	ca.authzs[i].status = status
+	ca.mu.Unlock()
+	writeJSON(w, map[string]string{"type": typ, "url": ca.url(r.URL.Path), "token": token, "status": status})
+}
+
+func (ca *fakeCA) finalize(w http.ResponseWriter, r *http.Request) {
+	var req struct{ CSR string }
+	ca.payload(r, &req)
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.mu.Lock()
+	ca.certPE = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+	ca.mu.Unlock()
+	w.Header().Set("Location", ca.url("/order/1"))
+	writeJSON(w, ca.orderJSON())
+}
+
+// newTestManager returns a manager for the fake CA with the account
+// thumbprint registered.
+func newTestManager(t *testing.T, ca *fakeCA, cache string, domains []string, s solver) *acmeManager {
+	t.Helper()
+	m, err := newACMEManager(ca.url("/dir"), ca.srv.Client(), domains, "ops@example.com", cache, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := acme.JWKThumbprint(m.client.Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.thumb = thumb
+	return m
+}
+
+func TestACME_HTTP01(t *testing.T) {
+	ca := newFakeCA(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.httpAddr = ln.Addr().String()
+	ln.Close()
+	h := &httpSolver{addr: ca.httpAddr}
+
+	cache := t.TempDir()
+	domains := []string{"a.example.com", "b.example.com"}
+	m := newTestManager(t, ca, cache, domains, h)
+
+	if _, err := m.getCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("getCertificate before issuance: want error")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cert.Leaf.DNSNames; len(got) != 2 || got[0] != "a.example.com" || got[1] != "b.example.com" {
+		t.Errorf("DNSNames = %v, want %v", got, domains)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("chain length = %d, want leaf and CA", len(cert.Certificate))
+	}
+	if m.needsRenewal(time.Now()) {
+		t.Error("fresh certificate needs renewal")
+	}
+	if !m.needsRenewal(time.Now().Add(70 * 24 * time.Hour)) {
+		t.Error("certificate expiring within 30 days doesn't need renewal")
+	}
+	if len(h.tokens) != 0 {
+		t.Errorf("tokens left after cleanup: %v", h.tokens)
+	}
+	if c, err := net.Dial("tcp", ca.httpAddr); err == nil {
+		c.Close()
+		t.Error("http-01 listener still open after the order")
+	}
+
+	// A new manager reuses the cached account key and certificate.
+	m2 := newTestManager(t, ca, cache, domains, h)
+	if m2.needsRenewal(time.Now()) {
+		t.Error("cached certificate not loaded")
+	}
+	if !m2.client.Key.Public().(*ecdsa.PublicKey).Equal(m.client.Key.Public()) {
+		t.Error("account key not reused")
+	}
+
+	// Adding a domain requires a new certificate.
+	m3 := newTestManager(t, ca, cache, append(domains, "c.example.com"), h)
+	if !m3.needsRenewal(time.Now()) {
+		t.Error("certificate missing a domain doesn't need renewal")
+	}
+}
+
+func TestACME_DNS01Hook(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+	records := filepath.Join(dir, "records")
+
+	// The hook stores TXT records as "name value" lines.
+	hook := filepath.Join(dir, "hook")
+	script := `#!/bin/sh
+case "$1" in
+present) echo "$3 $4" >> ` + records + ` ;;
+cleanup) echo "cleanup $2" >> ` + records + `.log ;;
+esac
+`
+	if err := os.WriteFile(hook, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	ca.lookupTXT = func(name string) string {
+		b, _ := os.ReadFile(records)
+		for _, ln := range strings.Split(string(b), "\n") {
+			if n, v, ok := strings.Cut(ln, " "); ok && n == name {
+				return v
+			}
+		}
+		return ""
+	}
+
+	m := newTestManager(t, ca, filepath.Join(dir, "cache"), []string{"a.example.com"}, dnsHook{path: hook})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.getCertificate(&tls.ClientHelloInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(records + ".log"); string(b) != "cleanup a.example.com\n" {
+		t.Errorf("cleanup log = %q", b)
+	}
+}
+
+func TestACME_ChallengeFails(t *testing.T) {
+	ca := newFakeCA(t)
+	solverSrv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(solverSrv.Close)
+	ca.httpAddr = strings.TrimPrefix(solverSrv.URL, "http://")
+
+	m := newTestManager(t, ca, t.TempDir(), []string{"a.example.com"}, &httpSolver{})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.renew(ctx); err == nil {
+		t.Fatal("renew succeeded with a failing challenge")
+	}
+	if _, err := m.getCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("getCertificate after failure: want error")
+	}
+}
+
+// stalledSolver never makes its challenge visible.
+type stalledSolver struct{}
+
+func (stalledSolver) Type() string { return "http-01" }
+
+func (stalledSolver) Present(ctx context.Context, _, _, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (stalledSolver) CleanUp(context.Context, string, string, string) error { return nil }
+
+func TestACME_Timeout(t *testing.T) {
+	ca := newFakeCA(t)
+	m := newTestManager(t, ca, t.TempDir(), []string{"a.example.com"}, stalledSolver{})
+	m.timeout = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() { done <- m.renew(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("renew = %v, want deadline exceeded", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("renew didn't give up after its timeout")
+	}
+}
+
+func TestHTTPSolver(t *testing.T) {
+	h := &httpSolver{}
+	_ = h.Present(context.Background(), "a.example.com", "tok", "tok.thumb")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/tok", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "tok.thumb" {
+		t.Errorf("challenge: %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/other", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("unknown token: status %d, want 404", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://a.example.com:80/slack/events?x=1", nil))
+	if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "https://a.example.com/slack/events?x=1" {
+		t.Errorf("redirect: %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://[2001:db8::1]:80/x", nil))
+	if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "https://[2001:db8::1]/x" {
+		t.Errorf("IPv6 redirect: %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+
+	_ = h.CleanUp(context.Background(), "a.example.com", "tok", "tok.thumb")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/tok", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("after cleanup: status %d, want 404", rw.Code)
+	}
+}
+
+// TestACME_Pebble runs against a local Pebble server when
+// TUN_TEST_PEBBLE is set to its directory URL, e.g.
+//
+//	pebble -config test/config/pebble-config.json &
+//	TUN_TEST_PEBBLE=https://localhost:14000/dir \
+//	TUN_TEST_PEBBLE_CA=test/certs/pebble.minica.pem \
+//	go test ./cmd/tund -run Pebble
+//
+// Pebble validates http-01 on port 5002 by default; the test serves
+// challenges there for "localhost".
+func TestACME_Pebble(t *testing.T) {
+	directory := os.Getenv("TUN_TEST_PEBBLE")
+	if directory == "" {
+		t.Skip("TUN_TEST_PEBBLE not set")
+	}
+
+	t.Setenv("TUN_ACME_DIRECTORY", directory)
+	t.Setenv("TUN_ACME_CA", os.Getenv("TUN_TEST_PEBBLE_CA"))
+	t.Setenv("TUN_ACME_CACHE", t.TempDir())
+	port := os.Getenv("TUN_TEST_PEBBLE_HTTP_PORT")
+	if port == "" {
+		port = "5002"
+	}
+	t.Setenv("TUN_ACME_HTTP_PORT", port)
+
+	m, err := newACMEFromEnv([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := m.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 10 * time.Minute},
+		{2, 20 * time.Minute},
+		{3, 40 * time.Minute},
+		{6, 320 * time.Minute},
+		{7, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.failures); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
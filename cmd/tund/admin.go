@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// admin serves the /admin/ API, requiring "Bearer token":
+//
+//	GET    /admin/tunnels       list connected tunnels
+//	DELETE /admin/tunnels/{id}  disconnect a tunnel
+//	GET    /admin/pending       list pending requests
+func (s *server) admin(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tunnels", s.handleAdminTunnels)
+	mux.HandleFunc("DELETE /admin/tunnels/{id}", s.handleAdminKick)
+	mux.HandleFunc("GET /admin/pending", s.handleAdminPending)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r has "Authorization: Bearer token",
+// comparing in constant time.
+func authorized(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+func (s *server) handleAdminTunnels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.tunnels.Tunnels())
+}
+
+func (s *server) handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	for _, t := range s.tunnels.Tunnels() {
+		if t.ID == id && s.tunnels.Disconnect(id) {
+			logger(t.User).Info("tunnel closed by admin", "tunnel_id", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "tunnel not found", http.StatusNotFound)
+}
+
+func (s *server) handleAdminPending(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.tunnels.Pending())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
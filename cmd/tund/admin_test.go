@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/croaky/tun"
+)
+
+func adminGet(t *testing.T, url string, v any) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	h := testServer(t).admin("admin")
+
+	for _, auth := range []string{"", "Bearer secret", "Bearer admin2"} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/tunnels", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got status %d, want %d", auth, rw.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminTunnels(t *testing.T) {
+	srv := httptest.NewServer(testServer(t).handler("", "admin"))
+	t.Cleanup(srv.Close)
+
+	var tunnels []tun.TunnelInfo
+	adminGet(t, srv.URL+"/admin/tunnels", &tunnels)
+	if len(tunnels) != 0 {
+		t.Fatalf("tunnels = %+v, want none", tunnels)
+	}
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	h.Set("X-Tunnel-User", "croaky")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tunnel", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := tun.NewSession(conn, false)
+	t.Cleanup(func() { _ = sess.Close() })
+
+	// Hold a request open: accept its stream but never answer.
+	go func() { _, _ = http.Get(srv.URL + "/slow") }()
+	st, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req tun.Request
+	if err := json.Unmarshal(st.Header(), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	var pending []tun.PendingRequest
+	adminGet(t, srv.URL+"/admin/pending", &pending)
+	if len(pending) != 1 || pending[0].ID != req.ID || pending[0].Path != "/slow" || pending[0].User != "croaky" {
+		t.Fatalf("pending = %+v, want GET /slow", pending)
+	}
+
+	adminGet(t, srv.URL+"/admin/tunnels", &tunnels)
+	if len(tunnels) != 1 {
+		t.Fatalf("tunnels = %+v, want one", tunnels)
+	}
+	got := tunnels[0]
+	if got.User != "croaky" || got.RemoteAddr == "" || got.ConnectedAt.IsZero() || got.Requests != 1 || got.Pending != 1 {
+		t.Errorf("tunnel = %+v", got)
+	}
+	if got.ID != pending[0].Tunnel {
+		t.Errorf("tunnel ID = %q, pending tunnel = %q", got.ID, pending[0].Tunnel)
+	}
+
+	kick := func(id string) int {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/admin/tunnels/"+id, nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := kick("unknown"); code != http.StatusNotFound {
+		t.Errorf("kick unknown: status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := kick(got.ID); code != http.StatusNoContent {
+		t.Errorf("kick: status %d, want %d", code, http.StatusNoContent)
+	}
+
+	select {
+	case <-sess.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client session not closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		adminGet(t, srv.URL+"/admin/tunnels", &tunnels)
+		if len(tunnels) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnels = %+v after kick, want none", tunnels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// limits caps the public requests forwarded to each tunnel.
+// Zero values disable a limit.
+type limits struct {
+	rate        float64 // requests per second
+	burst       int
+	maxInflight int
+}
+
+// parseLimits reads TUN_RATE_LIMIT, TUN_RATE_BURST, and TUN_MAX_INFLIGHT.
+// The burst defaults to one second of requests.
+func parseLimits(rate, burst, maxInflight string) (limits, error) {
+	var l limits
+	var err error
+	if rate = strings.TrimSpace(rate); rate != "" {
+		l.rate, err = strconv.ParseFloat(rate, 64)
+		if err != nil || l.rate <= 0 || math.IsInf(l.rate, 0) || math.IsNaN(l.rate) {
+			return l, fmt.Errorf("invalid TUN_RATE_LIMIT %q: want requests per second", rate)
+		}
+		l.burst = max(1, int(math.Ceil(l.rate)))
+	}
+	if burst = strings.TrimSpace(burst); burst != "" {
+		l.burst, err = strconv.Atoi(burst)
+		if err != nil || l.burst < 1 {
+			return l, fmt.Errorf("invalid TUN_RATE_BURST %q: want a positive integer", burst)
+		}
+	}
+	if maxInflight = strings.TrimSpace(maxInflight); maxInflight != "" {
+		l.maxInflight, err = strconv.Atoi(maxInflight)
+		if err != nil || l.maxInflight < 1 {
+			return l, fmt.Errorf("invalid TUN_MAX_INFLIGHT %q: want a positive integer", maxInflight)
+		}
+	}
+	return l, nil
+}
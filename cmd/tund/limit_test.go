@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		rate, burst, inflight string
+		want                  limits
+		wantErr               bool
+	}{
+		{"", "", "", limits{}, false},
+		{"10", "", "", limits{rate: 10, burst: 10}, false},
+		{"0.5", "", "", limits{rate: 0.5, burst: 1}, false},
+		{"2.5", "20", " 8 ", limits{rate: 2.5, burst: 20, maxInflight: 8}, false},
+		{"", "", "4", limits{maxInflight: 4}, false},
+		{"fast", "", "", limits{}, true},
+		{"0", "", "", limits{}, true},
+		{"-1", "", "", limits{}, true},
+		{"Inf", "", "", limits{}, true},
+		{"10", "0", "", limits{}, true},
+		{"", "", "none", limits{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLimits(tt.rate, tt.burst, tt.inflight)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLimits(%q, %q, %q) error = %v, wantErr %v", tt.rate, tt.burst, tt.inflight, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseLimits(%q, %q, %q) = %+v, want %+v", tt.rate, tt.burst, tt.inflight, got, tt.want)
+		}
+	}
+}
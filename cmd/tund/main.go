@@ -1,57 +1,89 @@
 // Command tund is the tunnel server.
 // Deploy this on a server to accept tunnel connections and proxy HTTP traffic.
+// It serves a tun.Server configured from the environment, alongside
+// health, readiness, metrics, and admin endpoints.
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
-	"io"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
-
 	"github.com/croaky/tun"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-const (
-	responseTimeout = 30 * time.Second
-	writeWait       = 5 * time.Second
-)
-
 func ms(d time.Duration) float64 {
 	return float64(d.Microseconds()) / 1000
 }
 
-func logf(user, format string, args ...any) {
-	if user != "" {
-		log.Printf("["+user+"] "+format, args...)
-	} else {
-		log.Printf(format, args...)
+// logger returns the default logger, tagged with user if set.
+func logger(user string) *slog.Logger {
+	if user == "" {
+		return slog.Default()
 	}
+	return slog.With("user", user)
 }
 
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// server adds tund's operational endpoints to a tun.Server.
 type server struct {
-	token   string
-	mu      sync.RWMutex
-	conn    *websocket.Conn
-	user    string
-	pending map[string]chan tun.Response
+	tunnels       *tun.Server
+	requireTunnel bool // /ready returns 503 without a tunnel
+	metrics       *metrics
+	tracer        *tun.Tracer // nil unless TUN_OTLP_ENDPOINT is set
+}
+
+// newServer returns a server whose tunnels report to its metrics.
+func newServer(opts tun.ServerOptions) (*server, error) {
+	s := &server{metrics: newMetrics(), tracer: opts.Tracer}
+	opts.OnConnect = func(t tun.TunnelInfo) { s.metrics.connected(t.User) }
+	opts.OnDisconnect = func(t tun.TunnelInfo) { s.metrics.disconnected(t.User) }
+	opts.OnRequest = func(r tun.RequestInfo) {
+		s.metrics.observe(r.User, r.Status, r.Duration, r.RequestBytes, r.Bytes)
+	}
+	ts, err := tun.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	s.tunnels = ts
+	s.metrics.pending = func() int64 { return int64(len(ts.Pending())) }
+	return s, nil
+}
+
+// handler serves tund's endpoints and forwards all other requests,
+// including tunnel connections, to the tun.Server.
+// The admin API is enabled only if adminToken is set.
+func (s *server) handler(metricsToken, adminToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/metrics", s.metrics.handler(metricsToken))
+	if adminToken != "" {
+		mux.Handle("/admin/", s.admin(adminToken))
+	}
+	mux.Handle("/", s.tunnels)
+	return mux
 }
 
 func main() {
-	log.SetFlags(0)
 	tun.Load(".env")
+	slog.SetDefault(tun.NewLogger(os.Stderr, strings.TrimSpace(os.Getenv("TUN_LOG_FORMAT"))))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -60,218 +92,167 @@ func main() {
 	addr := ":" + port
 
 	token := strings.TrimSpace(os.Getenv("TUN_TOKEN"))
-	if token == "" {
-		log.Fatal("TUN_TOKEN is required")
+	var ca *clientAuth
+	if name := strings.TrimSpace(os.Getenv("TUN_CLIENT_CA")); name != "" {
+		var err error
+		ca, err = newClientAuth(name, strings.TrimSpace(os.Getenv("TUN_CLIENT_CRL")))
+		if err != nil {
+			fatal("config error", "err", err)
+		}
 	}
-
-	s := &server{
-		token:   token,
-		pending: make(map[string]chan tun.Response),
+	if token == "" && ca == nil {
+		fatal("TUN_TOKEN or TUN_CLIENT_CA is required")
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
-	mux.HandleFunc("/tunnel", s.handleTunnel)
-	mux.HandleFunc("/", s.handleRequest)
-
-	log.Printf("tund listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
-}
-
-func (s *server) handleTunnel(w http.ResponseWriter, r *http.Request) {
-	got := r.Header.Get("Authorization")
-	const prefix = "Bearer "
-	if !strings.HasPrefix(got, prefix) || strings.TrimSpace(strings.TrimPrefix(got, prefix)) != s.token {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
+	var auth tun.Authenticator = tun.TokenAuth(token)
+	if ca != nil {
+		auth = ca.authenticator(token)
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	lim, err := parseLimits(os.Getenv("TUN_RATE_LIMIT"), os.Getenv("TUN_RATE_BURST"), os.Getenv("TUN_MAX_INFLIGHT"))
 	if err != nil {
-		log.Printf("websocket upgrade error: %v", err)
-		return
+		fatal("config error", "err", err)
 	}
 
-	user := r.Header.Get("X-Tunnel-User")
-
-	// Close existing connection if any (single tunnel at a time)
-	s.mu.Lock()
-	oldConn := s.conn
-	if oldConn != nil {
-		logf(s.user, "new tunnel connection, closing previous")
+	maxBody, err := tun.ParseSize(os.Getenv("TUN_MAX_REQUEST_BODY"))
+	if err != nil {
+		fatal("invalid TUN_MAX_REQUEST_BODY", "err", err)
 	}
-	s.conn = conn
-	s.user = user
-	s.mu.Unlock()
-
-	// Close old connection outside of lock
-	if oldConn != nil {
-		_ = oldConn.Close()
+	maxResBody, err := tun.ParseSize(os.Getenv("TUN_MAX_RESPONSE_BODY"))
+	if err != nil {
+		fatal("invalid TUN_MAX_RESPONSE_BODY", "err", err)
 	}
 
-	logf(user, "tunnel connected")
+	trusted, err := tun.ParsePrefixes(os.Getenv("TUN_TRUSTED_PROXIES"))
+	if err != nil {
+		fatal("invalid TUN_TRUSTED_PROXIES", "err", err)
+	}
 
-	// Keepalive: reset read deadlines on pong
-	conn.SetReadDeadline(time.Now().Add(tun.PongWait))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(tun.PongWait))
-		return nil
-	})
+	pubAuth := strings.TrimSpace(os.Getenv("TUN_PUBLIC_AUTH"))
+	if u, p, ok := strings.Cut(pubAuth, ":"); pubAuth != "" && (!ok || u == "" || p == "") {
+		fatal(`invalid TUN_PUBLIC_AUTH: want "user:pass"`)
+	}
 
-	done := make(chan struct{})
-	// Ping writer
-	go func() {
-		t := time.NewTicker(tun.PingPeriod)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				s.mu.Lock()
-				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
-				s.mu.Unlock()
-				if err != nil {
-					log.Printf("tunnel ping error: %v", err)
-					return
-				}
-			case <-done:
-				return
-			}
+	shutdownTimeout := defaultShutdownTimeout
+	if v := strings.TrimSpace(os.Getenv("TUN_SHUTDOWN_TIMEOUT")); v != "" {
+		shutdownTimeout, err = time.ParseDuration(v)
+		if err != nil || shutdownTimeout < 0 {
+			fatal("invalid TUN_SHUTDOWN_TIMEOUT: want a duration such as 25s", "value", v)
 		}
-	}()
+	}
 
-	// Read responses from client
-	for {
-		_, msg, err := conn.ReadMessage()
+	s, err := newServer(tun.ServerOptions{
+		Authenticator:   auth,
+		RateLimit:       lim.rate,
+		RateBurst:       lim.burst,
+		MaxInflight:     lim.maxInflight,
+		AllowTCP:        true,
+		TCPListenAddr:   strings.TrimSpace(os.Getenv("TUN_TCP_LISTEN_ADDR")),
+		MaxRequestBody:  maxBody,
+		MaxResponseBody: maxResBody,
+		TrustedProxies:  trusted,
+		PublicAuth:      pubAuth,
+		PublicToken:     strings.TrimSpace(os.Getenv("TUN_PUBLIC_TOKEN")),
+		Tracer:          tun.NewTracer(strings.TrimSpace(os.Getenv("TUN_OTLP_ENDPOINT")), "tund"),
+	})
+	if err != nil {
+		fatal("config error", "err", err)
+	}
+	s.requireTunnel = strings.TrimSpace(os.Getenv("TUN_READY_REQUIRE_TUNNEL")) == "1"
+
+	mux := s.handler(
+		strings.TrimSpace(os.Getenv("TUN_METRICS_TOKEN")),
+		strings.TrimSpace(os.Getenv("TUN_ADMIN_TOKEN")),
+	)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	// The listener reports here if it stops unexpectedly, so tund
+	// shuts down cleanly instead of exiting mid-request.
+	errc := make(chan error, 1)
+
+	certs := strings.Fields(os.Getenv("TUN_TLS_CERT"))
+	keys := strings.Fields(os.Getenv("TUN_TLS_KEY"))
+	domains := strings.Fields(os.Getenv("TUN_ACME_DOMAINS"))
+	switch {
+	case len(domains) > 0 && (len(certs) > 0 || len(keys) > 0):
+		fatal("set TUN_TLS_CERT or TUN_ACME_DOMAINS, not both")
+	case len(domains) > 0:
+		m, err := newACMEFromEnv(domains)
 		if err != nil {
-			// Don't log error if this connection was replaced by a new one
-			s.mu.RLock()
-			replaced := s.conn != conn
-			s.mu.RUnlock()
-			normalClose := websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
-			if !replaced && !normalClose {
-				logf(user, "tunnel read error: %v", err)
-			}
-			break
+			fatal("config error", "err", err)
 		}
-
-		var resp tun.Response
-		if err := json.Unmarshal(msg, &resp); err != nil {
-			log.Printf("invalid response: %v", err)
-			continue
+		go m.run(context.Background())
+		srv.TLSConfig = &tls.Config{GetCertificate: m.getCertificate}
+	case len(certs) > 0 || len(keys) > 0:
+		store, err := newCertStore(certs, keys)
+		if err != nil {
+			fatal("config error", "err", err)
 		}
-
-		s.mu.Lock()
-		if ch, ok := s.pending[resp.ID]; ok {
-			ch <- resp
-			delete(s.pending, resp.ID)
+		go store.watch()
+		srv.TLSConfig = &tls.Config{GetCertificate: store.getCertificate}
+	}
+	if ca != nil {
+		if srv.TLSConfig == nil {
+			fatal("TUN_CLIENT_CA requires TUN_TLS_CERT or TUN_ACME_DOMAINS")
 		}
-		s.mu.Unlock()
+		ca.tlsConfig(srv.TLSConfig)
 	}
 
-	close(done)
-
-	s.mu.Lock()
-	replaced := s.conn != conn
-	if s.conn == conn {
-		s.conn = nil
-		s.user = ""
-	}
-	s.mu.Unlock()
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			slog.Info("tund listening", "addr", addr, "tls", true)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("tund listening", "addr", addr)
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			errc <- err
+		}
+	}()
 
-	// Only log disconnect if not replaced (replacement logs its own message)
-	if !replaced {
-		logf(user, "tunnel disconnected")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case <-stop:
+		s.shutdown(srv, shutdownTimeout)
+	case err := <-errc:
+		slog.Error("listen error", "err", err)
+		s.shutdown(srv, shutdownTimeout)
+		os.Exit(1)
 	}
 }
 
-func (s *server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	s.mu.RLock()
-	conn := s.conn
-	s.mu.RUnlock()
-
-	if conn == nil {
-		log.Printf("%d %s %s %.2fms", http.StatusServiceUnavailable, r.Method, r.URL.RequestURI(), ms(time.Since(start)))
-		http.Error(w, "no tunnel connected", http.StatusServiceUnavailable)
-		return
-	}
-
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("%d %s %s %.2fms", http.StatusBadRequest, r.Method, r.URL.RequestURI(), ms(time.Since(start)))
-		http.Error(w, "failed to read body", http.StatusBadRequest)
-		return
-	}
-
-	headers := r.Header
-
-	// Create request ID and response channel
-	reqID := newID()
-	respChan := make(chan tun.Response, 1)
-
-	s.mu.Lock()
-	s.pending[reqID] = respChan
-	s.mu.Unlock()
-
-	// Send request to tunnel client
-	req := tun.Request{
-		ID:      reqID,
-		Method:  r.Method,
-		Path:    r.URL.RequestURI(),
-		Headers: headers,
-		Body:    body,
-	}
-
-	msg, err := json.Marshal(req)
-	if err != nil {
-		s.mu.Lock()
-		delete(s.pending, reqID)
-		s.mu.Unlock()
-		log.Printf("%d %s %s %.2fms", http.StatusInternalServerError, r.Method, r.URL.RequestURI(), ms(time.Since(start)))
-		http.Error(w, "marshal error", http.StatusInternalServerError)
-		return
-	}
-
-	s.mu.Lock()
-	err = conn.WriteMessage(websocket.TextMessage, msg)
-	s.mu.Unlock()
-	if err != nil {
-		s.mu.Lock()
-		delete(s.pending, reqID)
-		s.mu.Unlock()
-		log.Printf("%d %s %s %.2fms", http.StatusBadGateway, r.Method, r.URL.RequestURI(), ms(time.Since(start)))
-		http.Error(w, "tunnel write error", http.StatusBadGateway)
-		return
-	}
+// readiness is the /ready response body.
+type readiness struct {
+	Tunnels        int        `json:"tunnels"`
+	User           string     `json:"user,omitempty"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	LastPingRTTMs  float64    `json:"last_ping_rtt_ms"`
+	Pending        int64      `json:"pending"`
+}
 
-	// Wait for response with timeout
-	select {
-	case resp := <-respChan:
-		for k, vals := range resp.Headers {
-			for _, v := range vals {
-				w.Header().Add(k, v)
-			}
-		}
-		w.WriteHeader(resp.Status)
-		_, _ = w.Write(resp.Body)
-		log.Printf("%d %s %s %.2fms", resp.Status, r.Method, r.URL.RequestURI(), ms(time.Since(start)))
-	case <-time.After(responseTimeout):
-		s.mu.Lock()
-		delete(s.pending, reqID)
-		s.mu.Unlock()
-		log.Printf("%d %s %s %.2fms", http.StatusGatewayTimeout, r.Method, r.URL.RequestURI(), ms(time.Since(start)))
-		http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+// handleReady reports tunnel state. Unlike /health, it can fail
+// when no tunnel is attached.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	tunnels := s.tunnels.Tunnels()
+
+	var ready readiness
+	ready.Tunnels = len(tunnels)
+	if len(tunnels) > 0 {
+		t := tunnels[0]
+		ready.User = t.User
+		ready.ConnectedSince = &t.ConnectedAt
+		ready.LastPingRTTMs = ms(t.RTT)
 	}
-}
+	ready.Pending = int64(len(s.tunnels.Pending()))
 
-func newID() string {
-	var b [16]byte
-	if _, err := rand.Read(b[:]); err != nil {
-		return fmt.Sprintf("%d", time.Now().UnixNano())
+	status := http.StatusOK
+	if ready.Tunnels == 0 && s.requireTunnel {
+		status = http.StatusServiceUnavailable
 	}
-	return hex.EncodeToString(b[:])
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ready)
 }
@@ -1,67 +1,98 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 
 	"github.com/croaky/tun"
 )
 
-func TestHandleTunnelAuthUnauthorized(t *testing.T) {
-	s := &server{
-		token:   "secret",
-		pending: make(map[string]chan tun.Response),
-	}
-	r := httptest.NewRequest(http.MethodGet, "/tunnel", nil)
-	rw := httptest.NewRecorder()
-
-	s.handleTunnel(rw, r)
-
-	if rw.Code != http.StatusUnauthorized {
-		t.Fatalf("got status %d, want %d", rw.Code, http.StatusUnauthorized)
+// testServer returns a server admitting tunnels with the token "secret".
+func testServer(t *testing.T) *server {
+	t.Helper()
+	s, err := newServer(tun.ServerOptions{Authenticator: tun.TokenAuth("secret")})
+	if err != nil {
+		t.Fatal(err)
 	}
+	return s
 }
 
-func TestNewID(t *testing.T) {
-	id := newID()
-
-	// Should be 32 hex chars (16 bytes)
-	if len(id) != 32 {
-		t.Errorf("newID() length = %d, want 32", len(id))
+func TestHandleReady_NoTunnel(t *testing.T) {
+	tests := []struct {
+		name          string
+		requireTunnel bool
+		want          int
+	}{
+		{"liveness", false, http.StatusOK},
+		{"require tunnel", true, http.StatusServiceUnavailable},
 	}
 
-	// Should be valid hex
-	for _, c := range id {
-		if !strings.ContainsRune("0123456789abcdef", c) {
-			t.Errorf("newID() contains non-hex char: %c", c)
-		}
-	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			s.requireTunnel = tt.requireTunnel
+			rw := httptest.NewRecorder()
 
-	// Should be unique
-	id2 := newID()
-	if id == id2 {
-		t.Error("newID() returned duplicate IDs")
-	}
-}
+			s.handleReady(rw, httptest.NewRequest(http.MethodGet, "/ready", nil))
 
-func TestHandleRequest_NoTunnel(t *testing.T) {
-	s := &server{
-		token:   "secret",
-		pending: make(map[string]chan tun.Response),
-		// conn is nil - no tunnel connected
+			if rw.Code != tt.want {
+				t.Errorf("got status %d, want %d", rw.Code, tt.want)
+			}
+			var got readiness
+			if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Tunnels != 0 || got.ConnectedSince != nil {
+				t.Errorf("got %+v, want no tunnel", got)
+			}
+		})
 	}
+}
 
-	r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(`{}`))
-	rw := httptest.NewRecorder()
-
-	s.handleRequest(rw, r)
+func TestHandleReady_Connected(t *testing.T) {
+	s := testServer(t)
+	s.requireTunnel = true
+	srv := httptest.NewServer(s.handler("", ""))
+	t.Cleanup(srv.Close)
 
-	if rw.Code != http.StatusServiceUnavailable {
-		t.Errorf("got status %d, want %d", rw.Code, http.StatusServiceUnavailable)
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	h.Set("X-Tunnel-User", "croaky")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tunnel", h)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(rw.Body.String(), "no tunnel connected") {
-		t.Errorf("body = %q, want 'no tunnel connected'", rw.Body.String())
+	sess := tun.NewSession(conn, false)
+	t.Cleanup(func() { _ = sess.Close() })
+
+	// Wait for the first ping round trip
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(srv.URL + "/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got readiness
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode == http.StatusOK && got.LastPingRTTMs > 0 {
+			if got.Tunnels != 1 || got.User != "croaky" || got.ConnectedSince == nil {
+				t.Errorf("got %+v, want croaky's tunnel", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %d %+v, want ready tunnel", res.StatusCode, got)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the request latency histogram bounds in seconds.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// maxUsers caps the distinct user label values. With token auth
+// the user is the client's X-Tunnel-User header, so without a cap any
+// token holder could add series without bound by varying it.
+const maxUsers = 100
+
+// otherUser labels users past maxUsers or with unusual names.
+const otherUser = "other"
+
+// metrics collects counters for the /metrics endpoint
+// in the Prometheus text exposition format.
+type metrics struct {
+	mu          sync.Mutex
+	users       map[string]bool      // label values in use
+	requests    map[[2]string]uint64 // by user, status
+	durations   map[string]*histogram
+	bytesIn     map[string]uint64
+	bytesOut    map[string]uint64
+	connects    map[string]uint64
+	disconnects map[string]uint64
+	pending     func() int64 // public requests waiting on tunnels
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative; last is +Inf
+	sum    float64
+	total  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		users:       make(map[string]bool),
+		requests:    make(map[[2]string]uint64),
+		durations:   make(map[string]*histogram),
+		bytesIn:     make(map[string]uint64),
+		bytesOut:    make(map[string]uint64),
+		connects:    make(map[string]uint64),
+		disconnects: make(map[string]uint64),
+		pending:     func() int64 { return 0 },
+	}
+}
+
+// user returns the label value for user: user itself if it is a short
+// name of letters, digits, and ".@_-", and fewer than maxUsers users
+// have been seen, or otherUser. m.mu must be held.
+func (m *metrics) user(user string) string {
+	if m.users[user] {
+		return user
+	}
+	if len(user) > 64 || len(m.users) >= maxUsers {
+		return otherUser
+	}
+	for _, c := range user {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(".@_-", c)) {
+			return otherUser
+		}
+	}
+	m.users[user] = true
+	return user
+}
+
+// observe records a finished public request.
+func (m *metrics) observe(user string, status int, d time.Duration, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.user(user)
+
+	m.requests[[2]string{key, strconv.Itoa(status)}]++
+	m.bytesIn[key] += uint64(in)
+	m.bytesOut[key] += uint64(out)
+
+	h := m.durations[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+		m.durations[key] = h
+	}
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, sec)
+	h.counts[i]++
+	h.sum += sec
+	h.total++
+}
+
+func (m *metrics) connected(user string) {
+	m.mu.Lock()
+	m.connects[m.user(user)]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) disconnected(user string) {
+	m.mu.Lock()
+	m.disconnects[m.user(user)]++
+	m.mu.Unlock()
+}
+
+// handler serves the metrics, requiring "Bearer token" if token is set.
+func (m *metrics) handler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	}
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP tund_requests_total Public requests by tunnel user and status.")
+	fmt.Fprintln(w, "# TYPE tund_requests_total counter")
+	keys := make([][2]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "tund_requests_total{user=%s,status=%q} %d\n", label(k[0]), k[1], m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP tund_request_duration_seconds Public request latency.")
+	fmt.Fprintln(w, "# TYPE tund_request_duration_seconds histogram")
+	for _, user := range sortedKeys(m.durations) {
+		h := m.durations[user]
+		var cum uint64
+		for i, le := range durationBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "tund_request_duration_seconds_bucket{user=%s,le=%q} %d\n",
+				label(user), strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "tund_request_duration_seconds_bucket{user=%s,le=\"+Inf\"} %d\n", label(user), h.total)
+		fmt.Fprintf(w, "tund_request_duration_seconds_sum{user=%s} %g\n", label(user), h.sum)
+		fmt.Fprintf(w, "tund_request_duration_seconds_count{user=%s} %d\n", label(user), h.total)
+	}
+
+	fmt.Fprintln(w, "# HELP tund_pending_requests Public requests waiting on the tunnel.")
+	fmt.Fprintln(w, "# TYPE tund_pending_requests gauge")
+	fmt.Fprintf(w, "tund_pending_requests %d\n", m.pending())
+
+	writeCounter(w, "tund_request_bytes_total", "Public request body bytes sent into the tunnel.", m.bytesIn)
+	writeCounter(w, "tund_response_bytes_total", "Response body bytes returned from the tunnel.", m.bytesOut)
+	writeCounter(w, "tund_tunnel_connects_total", "Tunnel connections.", m.connects)
+	writeCounter(w, "tund_tunnel_disconnects_total", "Tunnel disconnections.", m.disconnects)
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, user := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{user=%s} %d\n", name, label(user), values[user])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// label quotes a label value per the exposition format.
+func label(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.connected("croaky")
+	m.observe("croaky", 200, 30*time.Millisecond, 100, 2)
+	m.observe("croaky", 200, 2*time.Second, 0, 5)
+	m.observe("croaky", 403, time.Millisecond, 0, 0)
+	m.pending = func() int64 { return 1 }
+	m.disconnected("croaky")
+
+	var b strings.Builder
+	m.write(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		`tund_requests_total{user="croaky",status="200"} 2`,
+		`tund_requests_total{user="croaky",status="403"} 1`,
+		`tund_request_duration_seconds_bucket{user="croaky",le="0.025"} 1`,
+		`tund_request_duration_seconds_bucket{user="croaky",le="0.05"} 2`,
+		`tund_request_duration_seconds_bucket{user="croaky",le="2.5"} 3`,
+		`tund_request_duration_seconds_bucket{user="croaky",le="+Inf"} 3`,
+		`tund_request_duration_seconds_count{user="croaky"} 3`,
+		`tund_pending_requests 1`,
+		`tund_request_bytes_total{user="croaky"} 100`,
+		`tund_response_bytes_total{user="croaky"} 7`,
+		`tund_tunnel_connects_total{user="croaky"} 1`,
+		`tund_tunnel_disconnects_total{user="croaky"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsUserLabel(t *testing.T) {
+	m := newMetrics()
+	m.connected("bad\nname")
+	m.connected(strings.Repeat("a", 65))
+	for i := range maxUsers + 5 {
+		m.connected(fmt.Sprintf("user%d", i))
+	}
+	m.connected("user0")
+
+	if got := len(m.connects); got != maxUsers+1 {
+		t.Errorf("got %d user labels, want %d plus other", got, maxUsers)
+	}
+	if got := m.connects["user0"]; got != 2 {
+		t.Errorf("connects{user0} = %d, want 2", got)
+	}
+	if got := m.connects[otherUser]; got != 7 {
+		t.Errorf("connects{other} = %d, want 7", got)
+	}
+}
+
+func TestMetricsHandlerToken(t *testing.T) {
+	h := newMetrics().handler("secret")
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		rw := httptest.NewRecorder()
+		h(rw, r)
+		if rw.Code != tt.want {
+			t.Errorf("auth %q: got status %d, want %d", tt.auth, rw.Code, tt.want)
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	if got, want := label("a\"b\\c\nd"), `"a\"b\\c\nd"`; got != want {
+		t.Errorf("label = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/croaky/tun"
+)
+
+// clientAuth identifies tunnel clients by certificates signed by a
+// team CA, rejecting any listed in an optional revocation list.
+type clientAuth struct {
+	roots   *x509.CertPool
+	cas     []*x509.Certificate
+	crlFile string
+
+	mu       sync.Mutex
+	crlMtime time.Time
+	revoked  map[string]bool // serial numbers
+}
+
+// newClientAuth loads the CA bundle and, if crlFile is set, the CRL.
+func newClientAuth(caFile, crlFile string) (*clientAuth, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read TUN_CLIENT_CA: %w", err)
+	}
+	a := &clientAuth{roots: x509.NewCertPool(), crlFile: crlFile}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("TUN_CLIENT_CA %s: %w", caFile, err)
+		}
+		a.roots.AddCert(ca)
+		a.cas = append(a.cas, ca)
+	}
+	if len(a.cas) == 0 {
+		return nil, fmt.Errorf("TUN_CLIENT_CA %s: no certificates found", caFile)
+	}
+	if crlFile != "" {
+		if err := a.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// tlsConfig asks clients for a certificate without requiring one,
+// so public callers and health checks connect as before.
+func (a *clientAuth) tlsConfig(cfg *tls.Config) {
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.ClientCAs = a.roots
+}
+
+// loadCRL reads the CRL, PEM or DER, and checks it was issued by a CA.
+func (a *clientAuth) loadCRL() error {
+	fi, err := os.Stat(a.crlFile)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.crlFile)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("TUN_CLIENT_CRL %s: %w", a.crlFile, err)
+	}
+	signed := false
+	for _, ca := range a.cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("TUN_CLIENT_CRL %s: not signed by TUN_CLIENT_CA", a.crlFile)
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.String()] = true
+	}
+	a.mu.Lock()
+	a.revoked = revoked
+	a.crlMtime = fi.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+// reloadCRL reloads the CRL if the file changed. A CRL that fails
+// to load leaves the previous one in effect.
+func (a *clientAuth) reloadCRL() {
+	if a.crlFile == "" {
+		return
+	}
+	fi, err := os.Stat(a.crlFile)
+	a.mu.Lock()
+	changed := err == nil && !fi.ModTime().Equal(a.crlMtime)
+	a.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err := a.loadCRL(); err != nil {
+		slog.Error("crl reload error", "err", err, "file", a.crlFile)
+		return
+	}
+	slog.Info("crl reloaded", "file", a.crlFile)
+}
+
+// identity returns the user and tunnel name from the verified client
+// certificate: its subject common name and first organizational unit.
+func (a *clientAuth) identity(cs *tls.ConnectionState) (user, name string, err error) {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return "", "", errors.New("no client certificate")
+	}
+	leaf := cs.VerifiedChains[0][0]
+
+	a.reloadCRL()
+	a.mu.Lock()
+	revoked := a.revoked[leaf.SerialNumber.String()]
+	a.mu.Unlock()
+	if revoked {
+		return "", "", fmt.Errorf("client certificate %s revoked", leaf.SerialNumber)
+	}
+
+	user = leaf.Subject.CommonName
+	if user == "" {
+		return "", "", errors.New("client certificate has no common name")
+	}
+	if len(leaf.Subject.OrganizationalUnit) > 0 {
+		name = leaf.Subject.OrganizationalUnit[0]
+	}
+	return user, name, nil
+}
+
+// authenticator admits tunnel clients presenting a valid certificate,
+// and the bearer token too if one is set.
+func (a *clientAuth) authenticator(token string) tun.Authenticator {
+	return tun.AuthenticatorFunc(func(r *http.Request) (tun.Identity, error) {
+		if token != "" {
+			if _, err := tun.TokenAuth(token).Authenticate(r); err != nil {
+				return tun.Identity{}, err
+			}
+		}
+		user, name, err := a.identity(r.TLS)
+		if err != nil {
+			return tun.Identity{}, err
+		}
+		return tun.Identity{User: user, Name: name}, nil
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/croaky/tun"
+)
+
+// testCA issues client certificates and CRLs.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue returns a client certificate for subject.
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCRL writes a PEM CRL revoking serials to file.
+func (ca *testCA) writeCRL(t *testing.T, file string, number int64, serials ...int64) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, n := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(n), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "team")
+	crl := filepath.Join(dir, "team.crl")
+	ca.writeCRL(t, crl, 1)
+
+	auth, err := newClientAuth(ca.file, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := tun.NewServer(tun.ServerOptions{Authenticator: auth.authenticator("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/tunnel", ts)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{}
+	auth.tlsConfig(srv.TLS)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	var tunnels []tun.TunnelInfo
+	dial := func(cert *tls.Certificate) (int, error) {
+		d := *websocket.DefaultDialer
+		d.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		if cert != nil {
+			d.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, res, err := d.Dial("wss"+strings.TrimPrefix(srv.URL, "https")+"/tunnel", nil)
+		if err != nil {
+			if res != nil {
+				return res.StatusCode, err
+			}
+			return 0, err
+		}
+		defer conn.Close()
+
+		// Wait for the tunnel to register.
+		for range 100 {
+			if tunnels = ts.Tunnels(); len(tunnels) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return res.StatusCode, nil
+	}
+
+	alice := ca.issue(t, 10, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"laptop"}})
+	if code, err := dial(&alice); err != nil {
+		t.Fatalf("dial with cert: %d %v", code, err)
+	}
+	if len(tunnels) != 1 || tunnels[0].User != "alice" || tunnels[0].Name != "laptop" {
+		t.Fatalf("tunnels = %+v, want user alice, name laptop", tunnels)
+	}
+
+	// Public callers without a certificate still connect.
+	res, err := srv.Client().Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if code, _ := dial(nil); code != http.StatusUnauthorized {
+		t.Errorf("dial without cert: status %d, want 401", code)
+	}
+
+	other := newTestCA(t, dir, "other")
+	mallory := other.issue(t, 10, pkix.Name{CommonName: "mallory"})
+	if _, err := dial(&mallory); err == nil {
+		t.Error("dial with cert from another CA succeeded")
+	}
+
+	noName := ca.issue(t, 11, pkix.Name{})
+	if code, _ := dial(&noName); code != http.StatusUnauthorized {
+		t.Errorf("dial with cert lacking CN: status %d, want 401", code)
+	}
+
+	// Revoking alice's certificate takes effect on her next connection.
+	ca.writeCRL(t, crl, 2, 10)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(crl, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := dial(&alice); code != http.StatusUnauthorized {
+		t.Errorf("dial with revoked cert: status %d, want 401", code)
+	}
+	bob := ca.issue(t, 12, pkix.Name{CommonName: "bob"})
+	if code, err := dial(&bob); err != nil {
+		t.Errorf("dial with unrevoked cert: %d %v", code, err)
+	}
+}
+
+func TestNewClientAuthErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "team")
+	other := newTestCA(t, dir, "other")
+
+	if _, err := newClientAuth(filepath.Join(dir, "missing.pem"), ""); err == nil {
+		t.Error("missing CA file: want error")
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a cert"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newClientAuth(empty, ""); err == nil {
+		t.Error("CA file without certificates: want error")
+	}
+
+	crl := filepath.Join(dir, "other.crl")
+	other.writeCRL(t, crl, 1)
+	if _, err := newClientAuth(ca.file, crl); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("CRL from another CA: err = %v, want not signed", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// defaultShutdownTimeout fits within Render's 30 second grace period.
+const defaultShutdownTimeout = 25 * time.Second
+
+// shutdown stops accepting connections, waits up to timeout for pending
+// public requests, then tells the tunnel client to reconnect elsewhere.
+func (s *server) shutdown(srv *http.Server, timeout time.Duration) {
+	slog.Info("shutting down", "timeout", timeout)
+
+	// Shutdown doesn't wait for hijacked connections,
+	// so the tunnel stays up to answer pending requests.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		n := len(s.tunnels.Pending())
+		slog.Error("shutdown error", "err", err, "pending", n)
+	}
+
+	_ = s.tunnels.Close()
+
+	s.tracer.Close()
+	slog.Info("shutdown complete")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/croaky/tun"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	s := testServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: s.handler("", "")}
+	go func() { _ = srv.Serve(ln) }()
+	base := "http://" + ln.Addr().String()
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/tunnel", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := tun.NewSession(conn, false)
+	t.Cleanup(func() { _ = sess.Close() })
+
+	// The client answers once told to, so the request is pending
+	// when shutdown starts.
+	answer := make(chan struct{})
+	go func() {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		<-answer
+		line, _ := json.Marshal(tun.Response{Status: http.StatusOK})
+		_, _ = st.Write(append(line, '\n'))
+		_, _ = st.Write([]byte("done"))
+		_ = st.Close()
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		res, err := http.Get(base + "/slow")
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		got <- result{string(b), err}
+	}()
+	for len(s.tunnels.Pending()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.shutdown(srv, 5*time.Second)
+		close(stopped)
+	}()
+
+	// New connections are refused while the pending request drains.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := http.Get(base + "/new"); err == nil {
+		t.Error("request during shutdown succeeded")
+	}
+	select {
+	case <-sess.GoingAway():
+		t.Fatal("GoAway sent before pending requests finished")
+	default:
+	}
+
+	close(answer)
+	r := <-got
+	if r.err != nil || r.body != "done" {
+		t.Fatalf("pending request = %q, %v; want done", r.body, r.err)
+	}
+
+	select {
+	case <-sess.GoingAway():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not get GoAway")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return")
+	}
+	<-sess.Done()
+	if !websocket.IsCloseError(sess.Err(), websocket.CloseNormalClosure) {
+		t.Errorf("session err = %v, want normal closure", sess.Err())
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := testServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: mux, ConnState: func(c net.Conn, state http.ConnState) {
+		if state == http.StateActive {
+			close(started)
+		}
+	}}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	go func() { _, _ = http.Get("http://" + ln.Addr().String() + "/stuck") }()
+	<-started
+
+	start := time.Now()
+	s.shutdown(srv, 100*time.Millisecond)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown took %s with a 100ms timeout", d)
+	}
+}
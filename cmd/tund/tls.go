@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often certificate files are checked for changes.
+const certReloadInterval = 30 * time.Second
+
+// certStore serves certificates loaded from files, chosen by SNI,
+// and reloads them when the files change.
+type certStore struct {
+	files []certFiles
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate // parallel to files
+}
+
+type certFiles struct {
+	cert, key string
+	mtime     time.Time // latest of the two files
+}
+
+// newCertStore loads each certificate with the key at the same position.
+func newCertStore(certs, keys []string) (*certStore, error) {
+	if len(certs) == 0 || len(certs) != len(keys) {
+		return nil, errors.New("TUN_TLS_CERT and TUN_TLS_KEY must list the same number of files")
+	}
+	c := &certStore{certs: make([]*tls.Certificate, len(certs))}
+	for i := range certs {
+		c.files = append(c.files, certFiles{cert: certs[i], key: keys[i]})
+		if err := c.load(i); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *certStore) load(i int) error {
+	f := &c.files[i]
+	mtime, err := latestMtime(f.cert, f.key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", f.cert, err)
+	}
+	f.mtime = mtime
+
+	c.mu.Lock()
+	c.certs[i] = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func latestMtime(names ...string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload reloads certificates whose files changed. A certificate that
+// fails to load keeps serving its previous version.
+func (c *certStore) reload() {
+	for i, f := range c.files {
+		mtime, err := latestMtime(f.cert, f.key)
+		if err != nil || mtime.Equal(f.mtime) {
+			continue
+		}
+		if err := c.load(i); err != nil {
+			slog.Error("tls reload error", "err", err, "file", f.cert)
+			continue
+		}
+		slog.Info("tls reloaded", "file", f.cert)
+	}
+}
+
+func (c *certStore) watch() {
+	for range time.Tick(certReloadInterval) {
+		c.reload()
+	}
+}
+
+// getCertificate picks the first certificate valid for the client's
+// server name, or the first certificate if none is.
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, cert := range c.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for host to dir,
+// returning the cert and key paths and the parsed certificate.
+func writeCert(t *testing.T, dir, host string, serial int64) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, host+".pem")
+	keyFile := filepath.Join(dir, host+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// handshake connects to addr with SNI host and returns the served certificate.
+func handshake(t *testing.T, addr, host string) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	aCert, aKey, a := writeCert(t, dir, "a.example.com", 1)
+	bCert, bKey, b := writeCert(t, dir, "b.example.com", 2)
+
+	store, err := newCertStore([]string{aCert, bCert}, []string{aKey, bKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: store.getCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				_ = c.(*tls.Conn).Handshake()
+				_ = c.Close()
+			}(c)
+		}
+	}()
+	addr := ln.Addr().String()
+
+	tests := []struct {
+		host string
+		want *x509.Certificate
+	}{
+		{"a.example.com", a},
+		{"b.example.com", b},
+		{"other.example.com", a},
+	}
+	for _, tt := range tests {
+		if got := handshake(t, addr, tt.host); !got.Equal(tt.want) {
+			t.Errorf("SNI %s: served %s, want %s", tt.host, got.Subject.CommonName, tt.want.Subject.CommonName)
+		}
+	}
+
+	// Replace b's files; reload picks up the change.
+	_, _, b2 := writeCert(t, dir, "b.example.com", 3)
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{bCert, bKey} {
+		if err := os.Chtimes(f, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.reload()
+	if got := handshake(t, addr, "b.example.com"); !got.Equal(b2) {
+		t.Errorf("after reload: served serial %v, want %v", got.SerialNumber, b2.SerialNumber)
+	}
+
+	// A broken replacement keeps the previous certificate.
+	if err := os.WriteFile(bCert, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	if err := os.Chtimes(bCert, future, future); err != nil {
+		t.Fatal(err)
+	}
+	store.reload()
+	if got := handshake(t, addr, "b.example.com"); !got.Equal(b2) {
+		t.Errorf("after bad reload: served serial %v, want %v", got.SerialNumber, b2.SerialNumber)
+	}
+}
+
+func TestNewCertStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	cert, key, _ := writeCert(t, dir, "a.example.com", 1)
+
+	tests := []struct {
+		name        string
+		certs, keys []string
+	}{
+		{"missing key", []string{cert}, nil},
+		{"mismatched counts", []string{cert, cert}, []string{key}},
+		{"missing file", []string{filepath.Join(dir, "nope.pem")}, []string{key}},
+		{"key for cert", []string{key}, []string{key}},
+	}
+	for _, tt := range tests {
+		if _, err := newCertStore(tt.certs, tt.keys); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package tun
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialer returns the WebSocket dialer for connecting to tund.
+// Without a Proxy, it honors HTTP_PROXY, HTTPS_PROXY, and NO_PROXY.
+func (c *Client) dialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.TLSClientConfig = c.opts.TLS
+	if c.opts.Proxy != nil {
+		d.Proxy = http.ProxyURL(c.opts.Proxy)
+	}
+	return &d
+}
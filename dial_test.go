@@ -0,0 +1,220 @@
+package tun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoServer accepts WebSocket connections and echoes one message.
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		typ, msg, err := conn.ReadMessage()
+		if err == nil {
+			_ = conn.WriteMessage(typ, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// connectProxy is an HTTP CONNECT proxy requiring basic auth,
+// recording the targets it tunnels to.
+func connectProxy(t *testing.T, user, pass string, targets chan<- string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		targets <- r.Host
+		w.WriteHeader(http.StatusOK)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_ = brw.Flush()
+		pipe(conn, upstream)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// socks5Proxy is a SOCKS5 proxy requiring username/password auth
+// (RFC 1928, RFC 1929), recording the targets it connects to.
+func socks5Proxy(t *testing.T, user, pass string, targets chan<- string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				target, err := socks5Handshake(conn, user, pass)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				targets <- target
+				_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(conn, upstream)
+			}()
+		}
+	}()
+	return ln
+}
+
+func socks5Handshake(conn net.Conn, user, pass string) (string, error) {
+	r := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	// Greeting: version, methods. Require username/password (2).
+	hdr := read(2)
+	if hdr == nil || hdr[0] != 5 || !bytes.Contains(read(int(hdr[1])), []byte{2}) {
+		_, _ = conn.Write([]byte{5, 0xff})
+		return "", errors.New("no acceptable auth method")
+	}
+	_, _ = conn.Write([]byte{5, 2})
+
+	ver := read(2)
+	if ver == nil {
+		return "", errors.New("short auth")
+	}
+	u := string(read(int(ver[1])))
+	pl := read(1)
+	if pl == nil {
+		return "", errors.New("short auth")
+	}
+	p := string(read(int(pl[0])))
+	if u != user || p != pass {
+		_, _ = conn.Write([]byte{1, 1})
+		return "", errors.New("bad credentials")
+	}
+	_, _ = conn.Write([]byte{1, 0})
+
+	// Request: version, CONNECT, reserved, address type.
+	req := read(4)
+	if req == nil || req[1] != 1 {
+		return "", errors.New("unsupported command")
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := read(2)
+	if port == nil {
+		return "", errors.New("short request")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+func pipe(a, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	b.Close()
+}
+
+func TestDialerProxy(t *testing.T) {
+	echo := echoServer(t)
+	wsURL := "ws" + strings.TrimPrefix(echo.URL, "http")
+	echoHost := strings.TrimPrefix(echo.URL, "http://")
+
+	targets := make(chan string, 1)
+	httpProxy := connectProxy(t, "alice", "s3cret", targets)
+	socks := socks5Proxy(t, "alice", "s3cret", targets)
+
+	for _, tt := range []struct {
+		name, proxy string
+		wantErr     bool
+	}{
+		{name: "http", proxy: "http://alice:s3cret@" + strings.TrimPrefix(httpProxy.URL, "http://")},
+		{name: "http bad password", proxy: "http://alice:wrong@" + strings.TrimPrefix(httpProxy.URL, "http://"), wantErr: true},
+		{name: "socks5", proxy: "socks5://alice:s3cret@" + socks.Addr().String()},
+		{name: "socks5 bad password", proxy: "socks5://alice:wrong@" + socks.Addr().String(), wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Client{opts: ClientOptions{Proxy: u}}
+			conn, _, err := c.dialer().Dial(wsURL, nil)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dial succeeded with bad proxy credentials")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := <-targets; got != echoHost {
+				t.Errorf("proxy target = %q, want %q", got, echoHost)
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			_, msg, err := conn.ReadMessage()
+			if err != nil || string(msg) != "hello" {
+				t.Errorf("echo = %q, %v", msg, err)
+			}
+		})
+	}
+}
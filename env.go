@@ -1,8 +1,11 @@
 package tun
 
 import (
+	"fmt"
 	"log"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -40,3 +43,52 @@ func Load(name string) {
 		}
 	}
 }
+
+// ParseSize parses a byte count such as "512", "64K", "10M", or "1G".
+// Suffixes are powers of 1024. An empty string is zero.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	if v == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// ParsePrefixes parses space-separated CIDRs such as "10.0.0.0/8 2001:db8::/32".
+// A bare IP address is a single-address prefix.
+func ParsePrefixes(v string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Fields(v) {
+		if !strings.Contains(f, "/") {
+			ip, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP %q", f)
+			}
+			ip = ip.Unmap()
+			out = append(out, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", f)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
@@ -1,6 +1,7 @@
 package tun
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -101,3 +102,60 @@ func TestLoadEnv_FileNotFound(t *testing.T) {
 	// Should not panic or error
 	Load("/nonexistent/path/.env")
 }
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"512", 512, false},
+		{" 64k ", 64 << 10, false},
+		{"10M", 10 << 20, false},
+		{"1G", 1 << 30, false},
+		{"M", 0, true},
+		{"1.5M", 0, true},
+		{"-1", 0, true},
+		{"10MB", 0, true},
+		{"99999999999G", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSize(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "[]", false},
+		{"10.0.0.0/8 192.168.1.7", "[10.0.0.0/8 192.168.1.7/32]", false},
+		{"10.1.2.3/8", "[10.0.0.0/8]", false},
+		{"2001:db8::/32 ::1", "[2001:db8::/32 ::1/128]", false},
+		{"::ffff:10.0.0.1", "[10.0.0.1/32]", false},
+		{"10.0.0.0/33", "", true},
+		{"example.com", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePrefixes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePrefixes(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && fmt.Sprint(got) != tt.want {
+			t.Errorf("ParsePrefixes(%q) = %v, want %s", tt.in, got, tt.want)
+		}
+	}
+}
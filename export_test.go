@@ -0,0 +1,6 @@
+package tun
+
+// Collector and OTLPSpan let the tun_test package check exported spans.
+var Collector = collector
+
+type OTLPSpan = otlpSpan
@@ -0,0 +1,138 @@
+package tun
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Public tokens are passed in a query parameter, which sets a cookie
+// of the same name so links within the tunneled site keep working.
+// The server's gate and a tunnel's have their own names, so callers
+// can pass both.
+const (
+	tunnelTokenParam = "tun_token"
+	serverTokenParam = "tun_server_token"
+)
+
+// gate requires public callers to present basic auth credentials or a
+// shared token before a request is forwarded. Either one is enough.
+type gate struct {
+	user, pass string
+	token      string
+	param      string // the query parameter and cookie carrying token
+}
+
+// parseGate reads "user:pass" basic auth credentials and a token
+// passed in param.
+func parseGate(basic, token, param string) (gate, error) {
+	g := gate{param: param}
+	if basic = strings.TrimSpace(basic); basic != "" {
+		var ok bool
+		g.user, g.pass, ok = strings.Cut(basic, ":")
+		if !ok || g.user == "" || g.pass == "" {
+			return g, errors.New(`basic auth must be "user:pass"`)
+		}
+	}
+	g.token = strings.TrimSpace(token)
+	return g, nil
+}
+
+func (g gate) enabled() bool {
+	return g.user != "" || g.token != ""
+}
+
+// credentials are the ways a request passed a gate.
+type credentials struct {
+	basic, query, cookie bool
+}
+
+// match returns the credentials in r that g accepts.
+func (g gate) match(r *http.Request) credentials {
+	var c credentials
+	if g.user != "" {
+		u, p, ok := r.BasicAuth()
+		c.basic = ok && equal(u, g.user) && equal(p, g.pass)
+	}
+	if g.token != "" {
+		v := r.URL.Query().Get(g.param)
+		c.query = v != "" && equal(v, g.token)
+		ck, err := r.Cookie(g.param)
+		c.cookie = err == nil && equal(ck.Value, g.token)
+	}
+	return c
+}
+
+// checkGates reports whether r passes every enabled gate, writing 401
+// if not. Once r passes, it removes the credentials from r so they
+// don't reach the local service.
+func checkGates(w http.ResponseWriter, r *http.Request, gates ...gate) bool {
+	used := make([]credentials, len(gates))
+	for i, g := range gates {
+		if !g.enabled() {
+			continue
+		}
+		c := g.match(r)
+		if !c.basic && !c.query && !c.cookie {
+			if g.user != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="tun", charset="UTF-8"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		used[i] = c
+	}
+
+	for i, c := range used {
+		g := gates[i]
+		if c.basic {
+			r.Header.Del("Authorization")
+		}
+		if c.query {
+			http.SetCookie(w, &http.Cookie{
+				Name:     g.param,
+				Value:    r.URL.Query().Get(g.param),
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+			r.URL.RawQuery = dropParam(r.URL.RawQuery, g.param)
+		}
+		if c.query || c.cookie {
+			dropCookie(r, g.param)
+		}
+	}
+	return true
+}
+
+// dropParam removes the named parameter from a raw query, leaving the
+// rest byte for byte, so signed URLs still verify.
+func dropParam(rawQuery, name string) string {
+	var kept []string
+	for _, p := range strings.Split(rawQuery, "&") {
+		k, _, _ := strings.Cut(p, "=")
+		if key, err := url.QueryUnescape(k); err == nil && key == name {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "&")
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// dropCookie removes the named cookie from r's Cookie header.
+func dropCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
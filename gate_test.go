@@ -0,0 +1,186 @@
+package tun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseGate(t *testing.T) {
+	tests := []struct {
+		basic, token string
+		want         gate
+		wantErr      bool
+	}{
+		{"", "", gate{param: "tun_token"}, false},
+		{"demo:s3cret", "", gate{user: "demo", pass: "s3cret", param: "tun_token"}, false},
+		{"demo:a:b", "", gate{user: "demo", pass: "a:b", param: "tun_token"}, false},
+		{"", " tok ", gate{token: "tok", param: "tun_token"}, false},
+		{"demo", "", gate{}, true},
+		{":pass", "", gate{}, true},
+		{"demo:", "", gate{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseGate(tt.basic, tt.token, "tun_token")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGate(%q, %q) error = %v, wantErr %v", tt.basic, tt.token, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseGate(%q, %q) = %+v, want %+v", tt.basic, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestGateCheck(t *testing.T) {
+	g := gate{user: "demo", pass: "s3cret", token: "tok", param: "tun_token"}
+
+	tests := []struct {
+		name    string
+		target  string
+		setup   func(r *http.Request)
+		want    bool
+		wantURI string
+	}{
+		{"no credentials", "/admin", nil, false, ""},
+		{"basic auth", "/admin", func(r *http.Request) { r.SetBasicAuth("demo", "s3cret") }, true, "/admin"},
+		{"wrong password", "/admin", func(r *http.Request) { r.SetBasicAuth("demo", "nope") }, false, ""},
+		{"query token", "/admin?tun_token=tok&page=2", nil, true, "/admin?page=2"},
+		{"query kept verbatim", "/hook?z=1&tun_token=tok&a=%2f+x&a=b", nil, true, "/hook?z=1&a=%2f+x&a=b"},
+		{"wrong query token", "/admin?tun_token=bad", nil, false, ""},
+		{"cookie", "/admin", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+			r.AddCookie(&http.Cookie{Name: "tun_token", Value: "tok"})
+		}, true, "/admin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			rw := httptest.NewRecorder()
+
+			if got := checkGates(rw, r, g); got != tt.want {
+				t.Fatalf("check = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				if rw.Code != http.StatusUnauthorized {
+					t.Errorf("got status %d, want %d", rw.Code, http.StatusUnauthorized)
+				}
+				if rw.Header().Get("WWW-Authenticate") == "" {
+					t.Error("missing WWW-Authenticate challenge")
+				}
+				return
+			}
+			if got := r.URL.RequestURI(); got != tt.wantURI {
+				t.Errorf("forwarded URI = %q, want %q", got, tt.wantURI)
+			}
+			if r.Header.Get("Authorization") != "" {
+				t.Error("basic auth credentials forwarded")
+			}
+			if _, err := r.Cookie("tun_token"); err == nil {
+				t.Error("token cookie forwarded")
+			}
+		})
+	}
+
+	// A valid query token sets the cookie for later requests
+	r := httptest.NewRequest(http.MethodGet, "/admin?tun_token=tok", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+	checkGates(rw, r, g)
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "tun_token" || cookies[0].Value != "tok" || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Errorf("cookies = %+v, want secure tun_token", cookies)
+	}
+}
+
+func TestCheckGatesBoth(t *testing.T) {
+	operator := gate{user: "ops", pass: "s3cret", param: "tun_server_token"}
+	client := gate{token: "tok", param: "tun_token"}
+
+	tests := []struct {
+		name  string
+		basic bool
+		token bool
+		want  bool
+	}{
+		{"neither", false, false, false},
+		{"operator only", true, false, false},
+		{"client only", false, true, false},
+		{"both", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/admin"
+			if tt.token {
+				target += "?tun_token=tok"
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.basic {
+				r.SetBasicAuth("ops", "s3cret")
+			}
+			rw := httptest.NewRecorder()
+			if got := checkGates(rw, r, operator, client); got != tt.want {
+				t.Fatalf("check = %v, want %v", got, tt.want)
+			}
+			if tt.want && (r.Header.Get("Authorization") != "" || r.URL.RawQuery != "") {
+				t.Errorf("credentials forwarded: %q %q", r.Header.Get("Authorization"), r.URL.RawQuery)
+			}
+		})
+	}
+
+	// Each gate's token has its own name, so callers can pass both.
+	operator = gate{token: "op", param: "tun_server_token"}
+	r := httptest.NewRequest(http.MethodGet, "/admin?tun_server_token=op&tun_token=tok&page=2", nil)
+	rw := httptest.NewRecorder()
+	if !checkGates(rw, r, operator, client) {
+		t.Fatal("both tokens: check = false, want true")
+	}
+	if got := r.URL.RawQuery; got != "page=2" {
+		t.Errorf("forwarded query = %q, want page=2", got)
+	}
+	if cookies := rw.Result().Cookies(); len(cookies) != 2 {
+		t.Errorf("cookies = %+v, want one per gate", cookies)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	r.AddCookie(&http.Cookie{Name: "tun_server_token", Value: "op"})
+	r.AddCookie(&http.Cookie{Name: "tun_token", Value: "tok"})
+	if !checkGates(httptest.NewRecorder(), r, operator, client) {
+		t.Fatal("both cookies: check = false, want true")
+	}
+	if len(r.Cookies()) != 0 {
+		t.Errorf("forwarded cookies = %+v, want none", r.Cookies())
+	}
+}
+
+func TestHandleRequest_GateUnauthorized(t *testing.T) {
+	s, requests := newTestServer(t, ServerOptions{})
+	s.tunnels[""] = &tunnel{id: "t1", user: "croaky", gate: gate{token: "tok", param: "tun_token"}}
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin", nil))
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+	assertRequest(t, requests, "croaky", http.StatusUnauthorized)
+}
+
+func TestHandleRequest_OperatorGate(t *testing.T) {
+	// A tunnel's own token doesn't replace the operator's.
+	s, requests := newTestServer(t, ServerOptions{PublicToken: "op"})
+	s.tunnels[""] = &tunnel{id: "t1", user: "croaky", gate: gate{token: "tok", param: "tun_token"}}
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin?tun_token=tok", nil))
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+	assertRequest(t, requests, "croaky", http.StatusUnauthorized)
+}
@@ -1,5 +1,7 @@
 module github.com/croaky/tun
 
-go 1.26
+go 1.26.0
 
 require github.com/gorilla/websocket v1.5.3
+
+require golang.org/x/crypto v0.57.0
@@ -1,8 +1,7 @@
-package tun
+package tun_test
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io"
 	"net"
@@ -10,149 +9,322 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
-)
 
-// pickFreePort reserves a free TCP port by binding :0 and closing.
-func pickFreePort(t *testing.T) string {
-	t.Helper()
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("listen :0: %v", err)
-	}
-	addr := ln.Addr().(*net.TCPAddr)
-	p := fmt.Sprintf("%d", addr.Port)
-	_ = ln.Close()
-	return p
-}
+	"github.com/croaky/tun"
+	"github.com/croaky/tun/tuntest"
+)
 
 func TestEndToEnd_TunnelForwardsRequest(t *testing.T) {
 	// Local HTTP service to receive tunneled requests
-	got := make(chan struct{}, 1)
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	got := make(chan string, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost || r.URL.Path != "/slack/events" {
-			t.Fatalf("unexpected %s %s", r.Method, r.URL.Path)
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
 		}
 		w.Header().Set("X-Test", "ok")
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("{}"))
 		select {
-		case got <- struct{}{}:
+		case got <- r.Header.Get("X-Request-ID"):
 		default:
 		}
 	}))
-	t.Cleanup(srv.Close)
+	t.Cleanup(local.Close)
 
-	port := pickFreePort(t)
-	wsURL := fmt.Sprintf("ws://127.0.0.1:%s/tunnel", port)
-	httpURL := fmt.Sprintf("http://127.0.0.1:%s/health", port)
-	forwardURL := fmt.Sprintf("http://127.0.0.1:%s/slack/events", port)
+	otlp, spans := tun.Collector(t)
+	tundTracer := tun.NewTracer(otlp, "tund")
+	tunTracer := tun.NewTracer(otlp, "tun")
 
-	// Start tund (absolute path, run from a clean temp dir so it won't read repo .env)
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	t.Cleanup(cancel)
-	root, err := os.Getwd()
+	s := tuntest.NewUnstartedServer(nil)
+	s.ServerOptions.Tracer = tundTracer
+	s.ClientOptions = tun.ClientOptions{
+		Local:  local.URL,
+		Allow:  []tun.Rule{{Method: "POST", Path: "/slack/events"}},
+		Tracer: tunTracer,
+	}
+	s.Start()
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/slack/events", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "itest-1")
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := s.Client().Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Test") != "ok" {
+		t.Fatalf("forward status=%d header[X-Test]=%q body=%s", resp.StatusCode, resp.Header.Get("X-Test"), b)
+	}
+	if got := resp.Header.Values("X-Request-ID"); len(got) != 1 || got[0] != "itest-1" {
+		t.Errorf("response X-Request-ID = %q, want [itest-1]", got)
+	}
+
+	select {
+	case id := <-got:
+		if id != "itest-1" {
+			t.Errorf("local X-Request-ID = %q, want itest-1", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("local server did not receive request")
+	}
 
-	absTund := "./cmd/tund"
-	tund := exec.CommandContext(ctx, "go", "run", absTund)
-	tund.Dir = root
-	tund.Env = []string{"PORT=" + port, "TUN_TOKEN=itest", "PATH=" + os.Getenv("PATH"), "HOME=" + os.Getenv("HOME")}
-	stderr, _ := tund.StderrPipe()
-	stdout, _ := tund.StdoutPipe()
-	if err := tund.Start(); err != nil {
-		t.Fatalf("start tund: %v", err)
-	}
-	t.Cleanup(func() { _ = tund.Process.Kill() })
-
-	// Wait for /health ready
-	deadline := time.Now().Add(8 * time.Second)
-	for time.Now().Before(deadline) {
-		resp, err := http.Get(httpURL)
-		if err == nil && resp.StatusCode == 200 {
-			_ = resp.Body.Close()
-			break
+	// Closing the tunnel finishes both spans; closing the tracers
+	// exports them.
+	s.Close()
+	tundTracer.Close()
+	tunTracer.Close()
+
+	// tund's span continues the caller's trace; tun's is its child.
+	var server, client *tun.OTLPSpan
+	all := spans()
+	for _, sp := range all {
+		if sp.Service == "tun" && sp.Kind == tun.SpanClient {
+			client = &sp
 		}
-		if resp != nil {
-			_ = resp.Body.Close()
+	}
+	for _, sp := range all {
+		if client != nil && sp.Service == "tund" && sp.SpanID == client.ParentSpanID {
+			server = &sp
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
+	if server == nil || client == nil {
+		t.Fatalf("spans = %+v, want tund's and tun's", all)
+	}
+	if server.Kind != tun.SpanServer || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("tund span %+v, want child of caller's span", server)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || client.TraceID != server.TraceID {
+		t.Errorf("trace IDs tund %s tun %s, want caller's", server.TraceID, client.TraceID)
+	}
+}
 
-	absTun := "./cmd/tun"
-	tunCmd := exec.CommandContext(ctx, "go", "run", absTun)
-	tunCmd.Dir = root
-	tunCmd.Env = []string{
-		"TUN_SERVER=" + wsURL,
-		"TUN_LOCAL=" + srv.URL,
-		"TUN_ALLOW=POST /slack/events",
-		"TUN_TOKEN=itest",
-		"PATH=" + os.Getenv("PATH"),
-		"HOME=" + os.Getenv("HOME"),
+func TestEndToEnd_TCPTunnelRelaysBytes(t *testing.T) {
+	echo := echoServer(t)
+
+	ports := make(chan map[string]int, 1)
+	s := tuntest.NewUnstartedServer(http.NotFoundHandler())
+	s.ServerOptions.AllowTCP = true
+	s.ServerOptions.TCPListenAddr = "127.0.0.1"
+	s.ClientOptions.TCP = map[string]string{"echo": echo}
+	s.ClientOptions.OnConnect = func(ci tun.ConnectInfo) {
+		select {
+		case ports <- ci.TCPPorts:
+		default:
+		}
 	}
-	tunStdout, _ := tunCmd.StdoutPipe()
-	tunStderr, _ := tunCmd.StderrPipe()
-	if err := tunCmd.Start(); err != nil {
-		t.Fatalf("start tun: %v", err)
+	s.Start()
+	defer s.Close()
+
+	port, ok := (<-ports)["echo"]
+	if !ok {
+		t.Fatal("no port for the echo tunnel")
 	}
-	t.Cleanup(func() { _ = tunCmd.Process.Kill() })
+	assertEcho(t, strconv.Itoa(port))
+}
 
-	// Poll until tunnel connected (server stops returning 503), then assert 200/ok
-	readyDeadline := time.Now().Add(8 * time.Second)
-	for {
-		resp, err := http.Post(forwardURL, "application/json", strings.NewReader("{}"))
-		if err == nil {
-			b, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			if resp.StatusCode != http.StatusServiceUnavailable { // not 503 => connected
-				if resp.StatusCode != 200 || resp.Header.Get("X-Test") != "ok" {
-					dump(t, "tund", stdout, stderr)
-					dump(t, "tun", tunStdout, tunStderr)
-					t.Fatalf("forward status=%d header[X-Test]=%q body=%s", resp.StatusCode, resp.Header.Get("X-Test"), string(b))
+// TestEndToEnd_Binaries runs the tund and tun commands, configured
+// as users do, with the environment and a tun.toml profile.
+func TestEndToEnd_Binaries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the commands")
+	}
+	bin := t.TempDir()
+	build := exec.Command("go", "build", "-o", bin, "./cmd/tund", "./cmd/tun")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from " + r.URL.Path))
+	}))
+	t.Cleanup(local.Close)
+	echo := echoServer(t)
+
+	// Run from an empty directory so no .env is read.
+	dir := t.TempDir()
+	port := freePort(t)
+	config := fmt.Sprintf(`[itest]
+server = "ws://127.0.0.1:%s/tunnel"
+local = %q
+allow = ["GET /hello"]
+tcp = "echo=%s"
+token_env = "ITEST_TOKEN"
+`, port, local.URL, echo)
+	if err := os.WriteFile(filepath.Join(dir, "tun.toml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=" + os.Getenv("PATH"), "HOME=" + os.Getenv("HOME")}
+
+	tund := command(t, dir, filepath.Join(bin, "tund"))
+	tund.Env = append(env, "PORT="+port, "TUN_TOKEN=itest", "TUN_TCP_LISTEN_ADDR=127.0.0.1")
+	start(t, tund)
+	waitHealthy(t, "http://127.0.0.1:"+port+"/health")
+
+	tunCmd := command(t, dir, filepath.Join(bin, "tun"), "start", "itest")
+	tunCmd.Env = append(env, "ITEST_TOKEN=itest")
+	stderr, err := tunCmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, tunCmd)
+
+	// The client logs "tcp tunnel open tcp=echo port=N ..." after connecting.
+	publicPort := make(chan string, 1)
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			fmt.Fprintln(tunCmd.Stdout, sc.Text())
+			if _, rest, ok := strings.Cut(sc.Text(), "tcp=echo port="); ok {
+				p, _, _ := strings.Cut(rest, " ")
+				select {
+				case publicPort <- p:
+				default:
 				}
-				break
 			}
 		}
-		if time.Now().After(readyDeadline) {
-			dump(t, "tund", stdout, stderr)
-			dump(t, "tun", tunStdout, tunStderr)
-			t.Fatal("tunnel did not become ready in time")
+	}()
+	var tcpPort string
+	select {
+	case tcpPort = <-publicPort:
+	case <-time.After(10 * time.Second):
+		t.Fatal("tunnel did not connect in time")
+	}
+
+	res, err := http.Get("http://127.0.0.1:" + port + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(b) != "hello from /hello" {
+		t.Errorf("GET /hello = %d %q, want 200 from the local service", res.StatusCode, b)
+	}
+	assertEcho(t, tcpPort)
+}
+
+// command returns cmd run in dir, killed when the test ends.
+// Its stdout and stderr are logged if the test fails.
+func command(t *testing.T, dir, name string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	var mu sync.Mutex
+	var out strings.Builder
+	cmd.Stdout = writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Write(p)
+	})
+	t.Cleanup(func() {
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+		if t.Failed() {
+			mu.Lock()
+			defer mu.Unlock()
+			t.Logf("%s output:\n%s", filepath.Base(name), out.String())
 		}
-		time.Sleep(150 * time.Millisecond)
+	})
+	return cmd
+}
+
+// start starts cmd. Its stderr goes to stdout unless piped.
+func start(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	if cmd.Stderr == nil {
+		cmd.Stderr = cmd.Stdout
 	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
 
-	select {
-	case <-got:
-		// ok
-	case <-time.After(2 * time.Second):
-		dump(t, "tund", stdout, stderr)
-		dump(t, "tun", tunStdout, tunStderr)
-		t.Fatal("local server did not receive request")
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// freePort returns a port that was free a moment ago.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
 }
 
-func dump(t *testing.T, name string, out, err io.Reader) {
+// waitHealthy waits for url to answer 200 OK.
+func waitHealthy(t *testing.T, url string) {
 	t.Helper()
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		sc := bufio.NewScanner(out)
-		for sc.Scan() {
-			t.Logf("[%s stdout] %s", name, sc.Text())
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, err := http.Get(url)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return
+			}
 		}
-	}()
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not healthy: %v", url, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// echoServer starts a TCP echo service and returns its address.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
 	go func() {
-		defer wg.Done()
-		sc := bufio.NewScanner(err)
-		for sc.Scan() {
-			t.Logf("[%s stderr] %s", name, sc.Text())
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
 		}
 	}()
-	wg.Wait()
+	return ln.Addr().String()
+}
+
+// assertEcho checks that bytes sent to port on loopback come back.
+func assertEcho(t *testing.T, port string) {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	want := "hello through the tunnel"
+	if _, err := c.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != want {
+		t.Errorf("echo = %q, want %q", buf, want)
+	}
 }
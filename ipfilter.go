@@ -0,0 +1,94 @@
+package tun
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter admits public callers by address. Deny wins over allow,
+// and a non-empty allow list admits only its members.
+type ipFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// parseIPFilter reads the X-Tunnel-IP-Allow and X-Tunnel-IP-Deny headers.
+func parseIPFilter(allow, deny string) (ipFilter, error) {
+	var f ipFilter
+	var err error
+	if f.allow, err = ParsePrefixes(allow); err != nil {
+		return f, err
+	}
+	if f.deny, err = ParsePrefixes(deny); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func (f ipFilter) enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+func (f ipFilter) allowed(ip netip.Addr) bool {
+	if contains(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || contains(f.allow, ip)
+}
+
+func contains(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the public caller's address. If the peer is a trusted
+// proxy, it is the rightmost X-Forwarded-For entry not itself trusted,
+// since entries left of that may be forged by the caller.
+func clientIP(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip = ip.Unmap()
+	if !contains(trusted, ip) {
+		return ip, true
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = hop.Unmap()
+		if !contains(trusted, ip) {
+			return ip, true
+		}
+	}
+	return ip, true // every hop is trusted; use the leftmost
+}
+
+// allowedIP reports whether t admits the caller of r.
+func (s *Server) allowedIP(t *tunnel, r *http.Request) bool {
+	if t == nil || !t.ips.enabled() {
+		return true
+	}
+	ip, ok := clientIP(r, s.opts.TrustedProxies)
+	if ok && t.ips.allowed(ip) {
+		return true
+	}
+	s.logger(t.user).Warn("blocked by ip filter", "tunnel_id", t.id, "client_ip", ip.String())
+	return false
+}
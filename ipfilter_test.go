@@ -0,0 +1,101 @@
+package tun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	tests := []struct {
+		allow, deny string
+		ip          string
+		want        bool
+	}{
+		{"", "", "203.0.113.9", true},
+		{"203.0.113.0/24", "", "203.0.113.9", true},
+		{"203.0.113.0/24", "", "198.51.100.1", false},
+		{"", "198.51.100.0/24", "198.51.100.1", false},
+		{"", "198.51.100.0/24", "203.0.113.9", true},
+		{"203.0.113.0/24", "203.0.113.9", "203.0.113.9", false},
+		{"2001:db8::/32", "", "2001:db8::1", true},
+		{"2001:db8::/32", "", "203.0.113.9", false},
+	}
+
+	for _, tt := range tests {
+		f, err := parseIPFilter(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.allowed(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("allow %q deny %q: allowed(%s) = %v, want %v", tt.allow, tt.deny, tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := parseIPFilter("10.0.0.0/8", "bogus"); err == nil {
+		t.Error("parseIPFilter accepted invalid deny list")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+		ok     bool
+	}{
+		{"direct", "203.0.113.9:1234", nil, "203.0.113.9", true},
+		{"untrusted peer ignores header", "203.0.113.9:1234", []string{"198.51.100.1"}, "203.0.113.9", true},
+		{"trusted proxy", "10.0.0.2:1234", []string{"203.0.113.9"}, "203.0.113.9", true},
+		{"forged left entries", "10.0.0.2:1234", []string{"198.51.100.1, 203.0.113.9"}, "203.0.113.9", true},
+		{"proxy chain", "10.0.0.2:1234", []string{"203.0.113.9, 10.0.0.3"}, "203.0.113.9", true},
+		{"repeated headers", "10.0.0.2:1234", []string{"198.51.100.1", "203.0.113.9"}, "203.0.113.9", true},
+		{"all trusted", "10.0.0.2:1234", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4", true},
+		{"no header", "10.0.0.2:1234", nil, "10.0.0.2", true},
+		{"mapped IPv4", "[::ffff:203.0.113.9]:1234", nil, "203.0.113.9", true},
+		{"invalid hop", "10.0.0.2:1234", []string{"unknown"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			ip, ok := clientIP(r, trusted)
+			if ok != tt.ok {
+				t.Fatalf("clientIP ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && ip.String() != tt.want {
+				t.Errorf("clientIP = %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequest_IPBlocked(t *testing.T) {
+	ips, err := parseIPFilter("203.0.113.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, requests := newTestServer(t, ServerOptions{})
+	s.tunnels[""] = &tunnel{id: "t1", user: "croaky", ips: ips}
+
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, r)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rw.Code, http.StatusForbidden)
+	}
+	assertRequest(t, requests, "croaky", http.StatusForbidden)
+}
@@ -0,0 +1,33 @@
+package tun
+
+import (
+	"errors"
+	"io"
+)
+
+// errBodyTooLarge is returned by a limitedBody read past its limit.
+var errBodyTooLarge = errors.New("body too large")
+
+// limitedBody reads at most n bytes from r and then fails with
+// errBodyTooLarge if more remain.
+type limitedBody struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Probe for one more byte to tell a body of exactly n from a longer one.
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
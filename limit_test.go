@@ -0,0 +1,54 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitedBody(t *testing.T) {
+	tests := []struct {
+		body    string
+		n       int64
+		wantErr error
+	}{
+		{"", 4, nil},
+		{"abc", 4, nil},
+		{"abcd", 4, nil},
+		{"abcde", 4, errBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		got, err := io.ReadAll(&limitedBody{r: strings.NewReader(tt.body), n: tt.n})
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("read %q with limit %d: error = %v, want %v", tt.body, tt.n, err, tt.wantErr)
+		}
+		if tt.wantErr == nil && string(got) != tt.body {
+			t.Errorf("read %q with limit %d: got %q", tt.body, tt.n, got)
+		}
+	}
+}
+
+func TestLimitedBody_LocalRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	body := &limitedBody{r: strings.NewReader(strings.Repeat("x", 1<<16)), n: 1 << 10}
+	req, err := http.NewRequest(http.MethodPost, srv.URL, io.NopCloser(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	res, err := http.DefaultClient.Do(req)
+	if err == nil {
+		res.Body.Close()
+	}
+	if !errors.Is(err, errBodyTooLarge) {
+		t.Errorf("error = %v, want errBodyTooLarge", err)
+	}
+}
@@ -0,0 +1,123 @@
+package tun
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewLogger returns the logger tun and tund write to w.
+//
+// With format "json", each record is a JSON object, for log aggregators.
+// Otherwise records print as "[user] message key=value ...", the plain
+// format both commands have always used, with the remaining attributes
+// after the message, and "[user/profile]" when a profile is set.
+// Messages are constant; details are attributes.
+//
+// Both commands use these attribute keys, each with one meaning:
+//
+//	user         the tunnel's user
+//	profile      the tun.toml profile, for tun start
+//	tunnel_id    the tunnel's ID, as in the admin API
+//	tunnel_name  the tunnel's routing name, with a Router
+//	tcp          the name of a TCP tunnel
+//	request_id   the public request's ID
+//	method, path, status, duration_ms, bytes   for requests
+//	err          the error, for failures
+func NewLogger(w io.Writer, format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, nil))
+	}
+	return slog.New(&textHandler{w: w, mu: &sync.Mutex{}})
+}
+
+// textHandler prints "[user/profile] message key=value ..." lines.
+type textHandler struct {
+	w       io.Writer
+	mu      *sync.Mutex
+	user    string // from WithAttrs
+	profile string // from WithAttrs
+	attrs   string // formatted, from WithAttrs
+}
+
+func (h *textHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= slog.LevelInfo
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	user, profile := h.user, h.profile
+	var b strings.Builder
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "user":
+			user = a.Value.String()
+		case "profile":
+			profile = a.Value.String()
+		default:
+			appendAttr(&b, a)
+		}
+		return true
+	})
+	b.WriteByte('\n')
+
+	line := b.String()
+	if prefix := strings.Trim(user+"/"+profile, "/"); prefix != "" {
+		line = "[" + prefix + "] " + line
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		switch a.Key {
+		case "user":
+			h2.user = a.Value.String()
+		case "profile":
+			h2.profile = a.Value.String()
+		default:
+			appendAttr(&b, a)
+		}
+	}
+	h2.attrs = b.String()
+	return &h2
+}
+
+func (h *textHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// appendAttr writes " key=value" to b, quoting values that need it.
+func appendAttr(b *strings.Builder, a slog.Attr) {
+	v := a.Value.Resolve()
+	if a.Key == "" || v.Kind() == slog.KindGroup {
+		return
+	}
+	b.WriteByte(' ')
+	b.WriteString(a.Key)
+	b.WriteByte('=')
+	var s string
+	switch v.Kind() {
+	case slog.KindFloat64:
+		s = strconv.FormatFloat(v.Float64(), 'f', -1, 64)
+	case slog.KindTime:
+		s = v.Time().Format(time.RFC3339)
+	default:
+		s = v.String()
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		s = strconv.Quote(s)
+	}
+	b.WriteString(s)
+}
@@ -0,0 +1,55 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestNewLogger_Text(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, "")
+
+	l.Info("tunnel connected")
+	l.With("user", "croaky", "method", "GET").Info("request", "path", "/", "status", 200, "duration_ms", 1.5)
+	l.Error("connection error", "user", "dan", "err", errors.New("unexpected EOF"))
+	l.With("profile", "slack").With("user", "croaky").Info("connected")
+	l.With("profile", "stripe").Info("connected")
+
+	want := "tunnel connected\n" +
+		"[croaky] request method=GET path=/ status=200 duration_ms=1.5\n" +
+		"[dan] connection error err=\"unexpected EOF\"\n" +
+		"[croaky/slack] connected\n" +
+		"[stripe] connected\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, "json")
+
+	l.With("user", "croaky").Info("request",
+		"request_id", "abc",
+		"status", 200,
+		"duration_ms", 1.0,
+	)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	for k, want := range map[string]any{
+		"msg":         "request",
+		"user":        "croaky",
+		"request_id":  "abc",
+		"status":      float64(200),
+		"duration_ms": 1.0,
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %v", k, got[k], want)
+		}
+	}
+}
@@ -0,0 +1,697 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Flow control and scheduling constants.
+// Window bounds the unacknowledged bytes in flight per stream, and so the
+// memory a stream can use on the receiving side. MaxFrameData bounds how
+// long one stream holds the connection before the next stream's turn.
+// MaxHeader bounds a stream's open header, which with MaxFrameData sets
+// the largest WebSocket message a session accepts.
+const (
+	Window       = 256 * 1024
+	MaxFrameData = 16 * 1024
+	MaxHeader    = 4 << 20
+
+	writeWait     = 5 * time.Second
+	acceptBacklog = 128
+
+	// closeDisconnected is the WebSocket close code a Server sends when
+	// it disconnects a tunnel on purpose. The Client stops rather than
+	// reconnecting.
+	closeDisconnected = 4000
+)
+
+var (
+	// ErrSessionClosed is returned by stream operations after the
+	// underlying WebSocket connection closes.
+	ErrSessionClosed = errors.New("tun: session closed")
+
+	// ErrStreamReset is returned by stream operations after either side
+	// calls Reset.
+	ErrStreamReset = errors.New("tun: stream reset")
+
+	// ErrHeaderTooLarge is returned by Open for headers over MaxHeader.
+	ErrHeaderTooLarge = errors.New("tun: stream header too large")
+
+	// ErrGoingAway is returned by Open after the peer sends GoAway.
+	ErrGoingAway = errors.New("tun: peer going away")
+)
+
+// errStreamID means the peer opened a stream with an ID from our
+// sequence, or not above its last one.
+var errStreamID = errors.New("tun: peer opened an invalid stream ID")
+
+// Session multiplexes streams over a single WebSocket connection.
+//
+// A stream starts with a FrameOpen carrying a header, then FrameData in
+// either direction; each side ends its half with FrameClose. A sender may
+// have at most Window unacknowledged bytes in flight per stream, and the
+// receiver returns credit with FrameWindow as the application reads.
+//
+// A single writer goroutine owns the connection. It sends control frames
+// first, then data from streams with pending bytes in round-robin order,
+// at most MaxFrameData per turn, so bulk transfers cannot starve
+// interactive ones.
+//
+// The server opens even-numbered streams and the client odd-numbered ones,
+// each in increasing order; a peer that breaks this ends the session.
+// Either side may send FrameGoAway before closing, so the peer stops
+// opening streams and, for a client, reconnects without backing off.
+// The session also sends keepalive pings and enforces PongWait.
+type Session struct {
+	conn *websocket.Conn
+
+	mu      sync.Mutex
+	wake    *sync.Cond // signals the writer
+	flushed *sync.Cond // signals Close that the writer went idle
+	writing bool       // the writer holds a frame not yet written
+	closing bool       // Close sent the WebSocket close frame
+	streams map[uint32]*Stream
+	next    uint32    // the ID our next Open uses
+	peer    uint32    // the last ID the peer opened
+	ctrl    [][]byte  // encoded control frames, sent before data
+	ready   []*Stream // streams with pending data, in round-robin order
+	err     error     // why the session closed
+	done    chan struct{}
+
+	goAwaySent chan struct{} // closed once our FrameGoAway is written
+	goAwayRecv chan struct{} // closed when the peer's FrameGoAway arrives
+	sentGoAway bool
+	recvGoAway bool
+
+	accept   chan *Stream
+	inflight int          // peer-opened streams not yet released; see pending
+	rtt      atomic.Int64 // last ping round trip, in nanoseconds
+}
+
+// NewSession starts multiplexing over conn.
+// server reports whether this side accepted the WebSocket connection.
+func NewSession(conn *websocket.Conn, server bool) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		next:    1,
+		done:    make(chan struct{}),
+		accept:  make(chan *Stream, acceptBacklog),
+
+		goAwaySent: make(chan struct{}),
+		goAwayRecv: make(chan struct{}),
+	}
+	if server {
+		s.next = 2
+	}
+	s.wake = sync.NewCond(&s.mu)
+	s.flushed = sync.NewCond(&s.mu)
+
+	conn.SetReadLimit(frameHeaderLen + MaxHeader)
+	conn.SetReadDeadline(time.Now().Add(PongWait))
+	conn.SetPongHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(PongWait))
+		// Pings carry their send time, so the echo measures round trip.
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			s.rtt.Store(int64(time.Since(time.Unix(0, sent))))
+		}
+		return nil
+	})
+
+	go s.readLoop()
+	go s.writeLoop()
+	go s.pingLoop()
+	return s
+}
+
+// Open starts a new stream with the given header.
+func (s *Session) Open(header []byte) (*Stream, error) {
+	if len(header) > MaxHeader {
+		return nil, ErrHeaderTooLarge
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, ErrSessionClosed
+	}
+	if s.recvGoAway {
+		return nil, ErrGoingAway
+	}
+	st := s.newStream(s.next, header)
+	s.next += 2
+	s.control(FrameOpen, st.id, header)
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Done is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// RTT returns the round trip time of the last answered ping,
+// or 0 if none has been answered yet.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+// GoAway tells the peer this side is shutting down, so it should open no
+// more streams. Existing streams continue. GoAway waits until the frame
+// is written, the session ends, or writeWait passes.
+func (s *Session) GoAway() {
+	s.mu.Lock()
+	if !s.sentGoAway && s.err == nil {
+		s.sentGoAway = true
+		s.control(FrameGoAway, 0, nil)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.goAwaySent:
+	case <-s.done:
+	case <-time.After(writeWait):
+	}
+}
+
+// GoingAway is closed when the peer sends GoAway.
+func (s *Session) GoingAway() <-chan struct{} {
+	return s.goAwayRecv
+}
+
+// Err returns why the session ended, or nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close sends frames already queued, such as the end of a response,
+// then a normal WebSocket close frame, and ends the session once the
+// peer answers it. Closing the connection before then could reset it
+// and discard data the peer hasn't read yet. Close waits at most
+// writeWait for each step.
+func (s *Session) Close() error {
+	return s.closeWith(websocket.CloseNormalClosure)
+}
+
+// closeWith is Close with the given WebSocket close code.
+func (s *Session) closeWith(code int) error {
+	s.flush(time.Now().Add(writeWait))
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	err := s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, ""),
+		time.Now().Add(writeWait))
+	if err == nil {
+		select {
+		case <-s.done:
+		case <-time.After(writeWait):
+		}
+	}
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// flush waits until the writer has sent every queued frame,
+// the session ends, or deadline passes.
+func (s *Session) flush(deadline time.Time) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		s.mu.Lock()
+		s.flushed.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for (s.writing || len(s.ctrl) > 0 || len(s.ready) > 0) && s.err == nil && time.Now().Before(deadline) {
+		s.flushed.Wait()
+	}
+}
+
+// fail ends the session and every stream with err.
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	for id, st := range s.streams {
+		st.fail(ErrSessionClosed)
+		s.release(st)
+		delete(s.streams, id)
+	}
+	s.wake.Broadcast()
+	s.flushed.Broadcast()
+	close(s.done)
+	s.mu.Unlock()
+	_ = s.conn.Close()
+}
+
+// newStream registers a stream. s.mu must be held.
+func (s *Session) newStream(id uint32, header []byte) *Stream {
+	st := &Stream{
+		id:     id,
+		sess:   s,
+		header: header,
+		window: Window,
+		done:   make(chan struct{}),
+	}
+	st.cond = sync.NewCond(&s.mu)
+	s.streams[id] = st
+	return st
+}
+
+// control queues a control frame. s.mu must be held.
+func (s *Session) control(op byte, id uint32, data []byte) {
+	msg, _ := Frame{Op: op, Stream: id, Data: data}.MarshalBinary()
+	s.ctrl = append(s.ctrl, msg)
+	s.wake.Signal()
+}
+
+// schedule queues st for the writer. s.mu must be held.
+func (s *Session) schedule(st *Stream) {
+	if st.queued {
+		return
+	}
+	st.queued = true
+	s.ready = append(s.ready, st)
+	s.wake.Signal()
+}
+
+// remove forgets st once both halves are closed or it was reset.
+// s.mu must be held.
+func (s *Session) remove(st *Stream) {
+	if st.err != nil || (st.finSent && st.finRecv) {
+		s.release(st)
+		delete(s.streams, st.id)
+	}
+}
+
+// pending returns how many streams the peer opened that are waiting
+// for Accept or still being served: not yet released, closed, or reset.
+// Counting from the open, rather than from Accept, covers streams
+// still in the accept backlog.
+func (s *Session) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inflight
+}
+
+// release stops counting st as pending. s.mu must be held.
+func (s *Session) release(st *Stream) {
+	if st.pending {
+		st.pending = false
+		s.inflight--
+	}
+}
+
+func (s *Session) writeLoop() {
+	for {
+		s.mu.Lock()
+		s.writing = false
+		s.flushed.Broadcast()
+		for len(s.ctrl) == 0 && len(s.ready) == 0 && s.err == nil {
+			s.wake.Wait()
+		}
+		if s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		msg := s.nextFrame()
+		s.writing = true
+		s.mu.Unlock()
+
+		if msg == nil {
+			continue
+		}
+		if err := s.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			s.fail(err)
+			return
+		}
+		if msg[0] == FrameGoAway {
+			close(s.goAwaySent)
+		}
+	}
+}
+
+// nextFrame returns the next encoded frame to send, or nil if the stream
+// whose turn it was had nothing left to send. s.mu must be held.
+func (s *Session) nextFrame() []byte {
+	if len(s.ctrl) > 0 {
+		msg := s.ctrl[0]
+		s.ctrl = s.ctrl[1:]
+		return msg
+	}
+
+	st := s.ready[0]
+	s.ready = s.ready[1:]
+	if st.err != nil {
+		st.queued = false
+		st.out = nil
+		return nil
+	}
+
+	var msg []byte
+	if k := min(len(st.out), MaxFrameData); k > 0 {
+		msg, _ = Frame{Op: FrameData, Stream: st.id, Data: st.out[:k]}.MarshalBinary()
+		st.out = st.out[k:]
+	}
+	if len(st.out) > 0 {
+		s.ready = append(s.ready, st)
+		return msg
+	}
+
+	st.queued = false
+	st.out = nil
+	if st.finQueued && !st.finSent {
+		// All data is queued ahead of the close, so control priority
+		// cannot reorder them.
+		st.finSent = true
+		s.control(FrameClose, st.id, nil)
+		s.remove(st)
+	}
+	return msg
+}
+
+func (s *Session) readLoop() {
+	for {
+		typ, msg, err := s.conn.ReadMessage()
+		if err != nil {
+			s.mu.Lock()
+			if s.closing {
+				err = ErrSessionClosed // the peer answered our close
+			}
+			s.mu.Unlock()
+			s.fail(err)
+			return
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		var f Frame
+		if err := f.UnmarshalBinary(msg); err != nil {
+			continue
+		}
+		if err := s.handle(f); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// handle applies a frame from the peer. It returns an error if the
+// peer broke the protocol, which ends the session.
+func (s *Session) handle(f Frame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.Op == FrameGoAway {
+		if !s.recvGoAway {
+			s.recvGoAway = true
+			close(s.goAwayRecv)
+		}
+		return nil
+	}
+
+	if f.Op == FrameOpen {
+		if s.err != nil {
+			return nil
+		}
+		// Peer IDs have the other parity and only increase, so an Open
+		// can't replace one of our streams or reuse one of its own.
+		if f.Stream%2 == s.next%2 || f.Stream <= s.peer {
+			return errStreamID
+		}
+		s.peer = f.Stream
+		st := s.newStream(f.Stream, f.Data)
+		select {
+		case s.accept <- st:
+			st.pending = true
+			s.inflight++
+		default:
+			st.fail(ErrStreamReset)
+			s.remove(st)
+			s.control(FrameReset, f.Stream, nil)
+		}
+		return nil
+	}
+
+	st := s.streams[f.Stream]
+	if st == nil {
+		return nil
+	}
+	switch f.Op {
+	case FrameData:
+		if st.closed {
+			// Nobody will read it; return the credit right away.
+			s.control(FrameWindow, st.id, credit(len(f.Data)))
+			return nil
+		}
+		if st.rbuf.Len()+len(f.Data) > Window {
+			st.fail(ErrStreamReset)
+			s.remove(st)
+			s.control(FrameReset, st.id, nil)
+			return nil
+		}
+		st.rbuf.Write(f.Data)
+	case FrameWindow:
+		if len(f.Data) == 4 {
+			st.window += int(binary.BigEndian.Uint32(f.Data))
+		}
+	case FrameClose:
+		st.finRecv = true
+		s.remove(st)
+	case FrameReset:
+		st.fail(ErrStreamReset)
+		s.remove(st)
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+// pingLoop pings right away, so RTT is known soon after connecting,
+// then every PingPeriod.
+func (s *Session) pingLoop() {
+	t := time.NewTicker(PingPeriod)
+	defer t.Stop()
+	for {
+		now := time.Now()
+		data := []byte(strconv.FormatInt(now.UnixNano(), 10))
+		if err := s.conn.WriteControl(websocket.PingMessage, data, now.Add(writeWait)); err != nil {
+			s.fail(err)
+			return
+		}
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func credit(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+// Stream is one bidirectional byte stream within a Session.
+// All fields after header are guarded by sess.mu.
+type Stream struct {
+	id     uint32
+	sess   *Session
+	header []byte
+
+	cond      *sync.Cond // wakes blocked readers and writers
+	rbuf      bytes.Buffer
+	unacked   int // bytes read but not yet credited to the peer
+	finRecv   bool
+	window    int    // send credit remaining
+	out       []byte // accepted by Write, not yet sent
+	queued    bool   // in sess.ready
+	finQueued bool
+	finSent   bool
+	closed    bool
+	pending   bool // counted in sess.inflight
+	err       error
+	done      chan struct{} // closed when err is set
+}
+
+// ID returns the stream's identifier within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Done is closed when the stream is reset or its session ends,
+// but not when it finishes normally.
+func (st *Stream) Done() <-chan struct{} {
+	return st.done
+}
+
+// Header returns the data the opener passed to Open.
+func (st *Stream) Header() []byte {
+	return st.header
+}
+
+// Read reads data sent by the peer, returning io.EOF after the peer
+// closes its half of the stream. Data and a close that arrived before
+// the session ended are still returned.
+func (st *Stream) Read(p []byte) (int, error) {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for st.rbuf.Len() == 0 && !st.finRecv && st.err == nil {
+		st.cond.Wait()
+	}
+	if st.err == ErrStreamReset || (st.err != nil && st.rbuf.Len() == 0 && !st.finRecv) {
+		return 0, st.err
+	}
+	if st.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	n, _ := st.rbuf.Read(p)
+	st.unacked += n
+	if st.unacked >= Window/2 && st.err == nil {
+		s.control(FrameWindow, st.id, credit(st.unacked))
+		st.unacked = 0
+	}
+	return n, nil
+}
+
+// Write queues p for sending, blocking while the peer's window is full.
+func (st *Stream) Write(p []byte) (int, error) {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		for st.window == 0 && st.err == nil && !st.finQueued {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			return n, st.err
+		}
+		if st.finQueued {
+			return n, io.ErrClosedPipe
+		}
+		k := min(len(p), st.window)
+		st.out = append(st.out, p[:k]...)
+		st.window -= k
+		p = p[k:]
+		n += k
+		s.schedule(st)
+	}
+	return n, nil
+}
+
+// CloseWrite closes the sending half of the stream after queued data.
+func (st *Stream) CloseWrite() error {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.finQueued || st.err != nil {
+		return st.err
+	}
+	st.finQueued = true
+	st.cond.Broadcast()
+	s.schedule(st)
+	return nil
+}
+
+// release stops counting st in the session's pending streams,
+// for streams such as TCP connections that a drain shouldn't wait for.
+func (st *Stream) release() {
+	st.sess.mu.Lock()
+	st.sess.release(st)
+	st.sess.mu.Unlock()
+}
+
+// Close closes the sending half and discards any further data from the
+// peer. Use Reset to abort the peer's half as well.
+func (st *Stream) Close() error {
+	_ = st.CloseWrite()
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !st.closed && st.rbuf.Len()+st.unacked > 0 && st.err == nil {
+		s.control(FrameWindow, st.id, credit(st.rbuf.Len()+st.unacked))
+	}
+	st.closed = true
+	st.rbuf.Reset()
+	st.unacked = 0
+	st.cond.Broadcast()
+	return nil
+}
+
+// Reset aborts the stream in both directions.
+// Blocked and future reads and writes return ErrStreamReset.
+func (st *Stream) Reset() {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.err != nil {
+		return
+	}
+	st.fail(ErrStreamReset)
+	s.remove(st)
+	s.control(FrameReset, st.id, nil)
+}
+
+// fail ends st with err, waking its readers and writers.
+// sess.mu must be held.
+func (st *Stream) fail(err error) {
+	if st.err != nil {
+		return
+	}
+	st.err = err
+	close(st.done)
+	st.cond.Broadcast()
+}
+
+// Pipe copies between st and c in both directions, propagating half-closes,
+// and closes both when done.
+func Pipe(st *Stream, c net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(st, c)
+		_ = st.CloseWrite()
+	}()
+
+	if _, err := io.Copy(c, st); err == nil {
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = c.Close()
+		}
+	} else {
+		_ = c.Close()
+	}
+	<-done
+	_ = c.Close()
+	_ = st.Close()
+}
@@ -0,0 +1,390 @@
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionPair returns connected server and client sessions.
+func sessionPair(t *testing.T) (srv, cli *Session) {
+	t.Helper()
+	ch := make(chan *Session, 1)
+	up := websocket.Upgrader{}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		ch <- NewSession(conn, true)
+	}))
+	t.Cleanup(hs.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli = NewSession(conn, false)
+	srv = <-ch
+	t.Cleanup(func() {
+		_ = cli.Close()
+		_ = srv.Close()
+	})
+	return srv, cli
+}
+
+func TestSessionEcho(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	go func() {
+		st, err := cli.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(st, st)
+		_ = st.Close()
+	}()
+
+	st, err := srv.Open([]byte("hdr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID()%2 != 0 {
+		t.Errorf("server stream ID = %d, want even", st.ID())
+	}
+
+	want := bytes.Repeat([]byte("0123456789"), 100_000) // 1MB, several windows
+	go func() {
+		_, _ = st.Write(want)
+		_ = st.CloseWrite()
+	}()
+
+	got, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("echoed %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestSessionHeader(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	if _, err := cli.Open([]byte("from client")); err != nil {
+		t.Fatal(err)
+	}
+	st, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(st.Header()); got != "from client" {
+		t.Errorf("header = %q, want %q", got, "from client")
+	}
+	if st.ID()%2 != 1 {
+		t.Errorf("client stream ID = %d, want odd", st.ID())
+	}
+}
+
+func TestSessionHeaderTooLarge(t *testing.T) {
+	srv, _ := sessionPair(t)
+
+	if _, err := srv.Open(make([]byte, MaxHeader+1)); !errors.Is(err, ErrHeaderTooLarge) {
+		t.Errorf("open error = %v, want ErrHeaderTooLarge", err)
+	}
+	if _, err := srv.Open(make([]byte, MaxHeader)); err != nil {
+		t.Errorf("open at MaxHeader: %v", err)
+	}
+}
+
+func TestSessionFairness(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	// The client drains every stream; report when each finishes.
+	finished := make(chan string, 2)
+	go func() {
+		for {
+			st, err := cli.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, st)
+				finished <- string(st.Header())
+			}()
+		}
+	}()
+
+	bulk, err := srv.Open([]byte("bulk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = bulk.Write(make([]byte, 64<<20))
+		_ = bulk.CloseWrite()
+	}()
+	time.Sleep(10 * time.Millisecond) // let bulk start
+
+	small, err := srv.Open([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = small.Write([]byte("ping"))
+	_ = small.CloseWrite()
+
+	select {
+	case first := <-finished:
+		if first != "small" {
+			t.Errorf("first finished = %q, want small", first)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no stream finished")
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	st, err := srv.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := cli.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := peer.Read(make([]byte, 1))
+		errc <- err
+	}()
+	st.Reset()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrStreamReset) {
+			t.Errorf("read error = %v, want ErrStreamReset", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not unblock after reset")
+	}
+	if _, err := st.Write([]byte("x")); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("write error = %v, want ErrStreamReset", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	st, err := srv.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = cli.Close()
+
+	select {
+	case <-srv.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session did not end")
+	}
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("read error = %v, want ErrSessionClosed", err)
+	}
+	if _, err := srv.Open(nil); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("open error = %v, want ErrSessionClosed", err)
+	}
+	if !websocket.IsCloseError(srv.Err(), websocket.CloseNormalClosure) {
+		t.Errorf("server err = %v, want normal closure", srv.Err())
+	}
+}
+
+func TestSessionCloseFlushes(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	st, err := srv.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := cli.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data written just before Close still reaches the peer.
+	want := bytes.Repeat([]byte("x"), Window)
+	if _, err := st.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	_ = st.CloseWrite()
+	_ = srv.Close()
+
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("read after peer closed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestSessionGoAway(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	// A stream opened before GoAway keeps working after it.
+	st, err := cli.Open([]byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.GoAway()
+	select {
+	case <-cli.GoingAway():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not see GoAway")
+	}
+	select {
+	case <-srv.GoingAway():
+		t.Error("sender sees its own GoAway")
+	default:
+	}
+
+	if _, err := cli.Open(nil); !errors.Is(err, ErrGoingAway) {
+		t.Errorf("open after GoAway: err = %v, want ErrGoingAway", err)
+	}
+	if _, err := srv.Open(nil); err != nil {
+		t.Errorf("sender open after GoAway: %v", err)
+	}
+
+	if _, err := st.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	_ = st.CloseWrite()
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "after" {
+		t.Errorf("read = %q, %v; want after", got, err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	// Local echo service on the client side
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+		_ = c.Close()
+	}()
+	go func() {
+		st, err := cli.Accept()
+		if err != nil {
+			return
+		}
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			st.Reset()
+			return
+		}
+		Pipe(st, c)
+	}()
+
+	st, err := srv.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = st.Write([]byte("hello"))
+	_ = st.CloseWrite()
+
+	got, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want hello", got)
+	}
+}
+
+func TestSessionRTT(t *testing.T) {
+	srv, cli := sessionPair(t)
+
+	// Both sides ping on start; pongs are answered by the peer's reader.
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.RTT() == 0 || cli.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("RTT not measured: server %v, client %v", srv.RTT(), cli.RTT())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionStreamID(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint32
+	}{
+		{"our parity", []uint32{2}},
+		{"reused", []uint32{3, 3}},
+		{"decreasing", []uint32{5, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan *Session, 1)
+			hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					t.Errorf("upgrade: %v", err)
+					return
+				}
+				ch <- NewSession(conn, true)
+			}))
+			t.Cleanup(hs.Close)
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			srv := <-ch
+			t.Cleanup(func() { _ = srv.Close() })
+
+			// A raw peer, since a Session never sends such IDs.
+			for _, id := range tt.ids {
+				msg, _ := Frame{Op: FrameOpen, Stream: id}.MarshalBinary()
+				if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case <-srv.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("session still open")
+			}
+			if err := srv.Err(); !errors.Is(err, errStreamID) {
+				t.Errorf("Err = %v, want errStreamID", err)
+			}
+			if n := srv.pending(); n != 0 {
+				t.Errorf("pending = %d, want 0", n)
+			}
+		})
+	}
+}
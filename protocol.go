@@ -2,7 +2,11 @@
 // It defines the protocol messages exchanged between the tunnel client and server.
 package tun
 
-import "time"
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
 
 // WebSocket keepalive constants.
 // PingPeriod must be less than PongWait to ensure pings are sent before
@@ -13,19 +17,64 @@ const (
 	PingPeriod = 20 * time.Second
 )
 
-// Request is sent from server to client through the WebSocket tunnel.
+// Request is the header of a stream the server opens to the client.
+//
+// For HTTP streams, the request body follows on the stream, and the client
+// replies with a JSON-encoded Response line followed by the response body.
+// For TCP streams (TCP is set), the stream carries raw bytes both ways.
 type Request struct {
 	ID      string              `json:"id"`
-	Method  string              `json:"method"`
-	Path    string              `json:"path"`
-	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
+	Method  string              `json:"method,omitempty"`
+	Path    string              `json:"path,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Length  int64               `json:"length,omitempty"` // body length, or -1 if unknown
+	TCP     string              `json:"tcp,omitempty"`    // TCP tunnel name
 }
 
-// Response is sent from client to server through the WebSocket tunnel.
+// Response is the first line the client writes on an HTTP stream.
 type Response struct {
-	ID      string              `json:"id"`
 	Status  int                 `json:"status"`
-	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+// Frame ops. See Session for how streams use them.
+const (
+	FrameOpen   byte = 1 // Data is the stream header
+	FrameData   byte = 2 // Data is stream bytes
+	FrameClose  byte = 3 // sender will write no more data
+	FrameWindow byte = 4 // Data is a big-endian uint32 credit increment
+	FrameReset  byte = 5 // stream aborted in both directions
+	FrameGoAway byte = 6 // session-wide: sender is going away; peer opens no more streams
+)
+
+// Frame is the unit of the multiplexed tunnel protocol.
+// Frames are sent as binary WebSocket messages. The encoding is the op byte,
+// the stream ID as a big-endian uint32, then the data.
+type Frame struct {
+	Op     byte
+	Stream uint32
+	Data   []byte
+}
+
+const frameHeaderLen = 5
+
+// MarshalBinary encodes f for a binary WebSocket message.
+func (f Frame) MarshalBinary() ([]byte, error) {
+	b := make([]byte, frameHeaderLen+len(f.Data))
+	b[0] = f.Op
+	binary.BigEndian.PutUint32(b[1:], f.Stream)
+	copy(b[frameHeaderLen:], f.Data)
+	return b, nil
+}
+
+// UnmarshalBinary decodes a binary WebSocket message into f.
+// f.Data aliases b.
+func (f *Frame) UnmarshalBinary(b []byte) error {
+	if len(b) < frameHeaderLen {
+		return fmt.Errorf("frame too short: %d bytes", len(b))
+	}
+	f.Op = b[0]
+	f.Stream = binary.BigEndian.Uint32(b[1:])
+	f.Data = b[frameHeaderLen:]
+	return nil
 }
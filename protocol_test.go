@@ -0,0 +1,35 @@
+package tun
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []Frame{
+		{Op: FrameOpen, Stream: 1, Data: []byte("pg")},
+		{Op: FrameData, Stream: 1<<32 - 1, Data: []byte{0, 1, 2}},
+		{Op: FrameClose, Stream: 7},
+	}
+
+	for _, want := range tests {
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Frame
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if got.Op != want.Op || got.Stream != want.Stream || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFrameUnmarshalShort(t *testing.T) {
+	var f Frame
+	if err := f.UnmarshalBinary([]byte{FrameData, 0, 0}); err == nil {
+		t.Error("want error, got nil")
+	}
+}
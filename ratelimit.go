@@ -0,0 +1,59 @@
+package tun
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled at rate tokens per second.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take removes a token if one is available, or returns
+// how long until one will be.
+func (b *bucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// admit reserves capacity on t for one request. If the tunnel is over
+// its limits, it returns false and how long the caller should wait;
+// otherwise the caller must call release when the request finishes.
+func (t *tunnel) admit(maxInflight int) (release func(), retry time.Duration, ok bool) {
+	if t == nil {
+		return func() {}, 0, true
+	}
+	if maxInflight > 0 && t.inflight.Add(1) > int64(maxInflight) {
+		t.inflight.Add(-1)
+		return nil, time.Second, false
+	}
+	release = func() {
+		if maxInflight > 0 {
+			t.inflight.Add(-1)
+		}
+	}
+	if t.bucket != nil {
+		if ok, wait := t.bucket.take(time.Now()); !ok {
+			release()
+			return nil, wait, false
+		}
+	}
+	return release, 0, true
+}
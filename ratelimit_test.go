@@ -0,0 +1,82 @@
+package tun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	b := newBucket(2, 3)
+	now := b.last
+
+	for i := range 3 {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("take %d within burst failed", i)
+		}
+	}
+	ok, wait := b.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("take over burst = %v, %v; want false, 500ms", ok, wait)
+	}
+
+	// Refill at 2 per second, capped at the burst
+	if ok, _ := b.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Error("take after refill failed")
+	}
+	now = now.Add(time.Hour)
+	for i := range 3 {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("take %d after idle failed", i)
+		}
+	}
+	if ok, _ := b.take(now); ok {
+		t.Error("bucket refilled past burst")
+	}
+}
+
+func TestAdmitMaxInflight(t *testing.T) {
+	tn := &tunnel{}
+
+	r1, _, ok := tn.admit(2)
+	if !ok {
+		t.Fatal("first request rejected")
+	}
+	r2, _, ok := tn.admit(2)
+	if !ok {
+		t.Fatal("second request rejected")
+	}
+	if _, retry, ok := tn.admit(2); ok || retry != time.Second {
+		t.Errorf("third request = %v, retry %v; want rejected, 1s", ok, retry)
+	}
+
+	r1()
+	if r3, _, ok := tn.admit(2); !ok {
+		t.Error("request after release rejected")
+	} else {
+		r3()
+	}
+	r2()
+	if got := tn.inflight.Load(); got != 0 {
+		t.Errorf("inflight = %d after releases, want 0", got)
+	}
+}
+
+func TestHandleRequest_RateLimited(t *testing.T) {
+	s, requests := newTestServer(t, ServerOptions{})
+	tn := &tunnel{id: "t1", user: "croaky", bucket: newBucket(0.25, 1)}
+	tn.bucket.tokens = 0
+	s.tunnels[""] = tn
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+	if got := rw.Header().Get("Retry-After"); got != "4" {
+		t.Errorf("Retry-After = %q, want 4", got)
+	}
+	assertRequest(t, requests, "croaky", http.StatusTooManyRequests)
+}
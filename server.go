@@ -0,0 +1,775 @@
+package tun
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// ResponseTimeout bounds how long a public request waits for the
+// tunnel client to start its response.
+const ResponseTimeout = 30 * time.Second
+
+// defaultMaxTCPTunnels is the default ServerOptions.MaxTCPTunnels.
+const defaultMaxTCPTunnels = 8
+
+// ErrUnauthorized is returned by an Authenticator that rejects a client.
+var ErrUnauthorized = errors.New("tun: unauthorized")
+
+var (
+	// errResponseTooLarge means a response exceeded MaxResponseBody.
+	errResponseTooLarge = errors.New("response body exceeds MaxResponseBody")
+
+	// errTruncated means a response failed after its status was sent.
+	errTruncated = errors.New("response truncated")
+)
+
+// Identity is an authenticated tunnel client.
+type Identity struct {
+	User string // names the tunnel in logs and metrics
+	Name string // routes requests to the tunnel if the Server has a Router
+}
+
+// An Authenticator admits tunnel clients. It is called with the
+// WebSocket handshake request before upgrading.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (Identity, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Identity, error) {
+	return f(r)
+}
+
+// TokenAuth returns an Authenticator requiring "Authorization: Bearer token".
+// The user is the client's X-Tunnel-User header.
+func TokenAuth(token string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		got := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(got, prefix) || !equal(strings.TrimSpace(strings.TrimPrefix(got, prefix)), token) {
+			return Identity{}, ErrUnauthorized
+		}
+		return Identity{User: r.Header.Get("X-Tunnel-User")}, nil
+	})
+}
+
+// A Router picks the tunnel for a public request by Identity.Name.
+type Router interface {
+	Route(r *http.Request) string
+}
+
+// RouterFunc adapts a function to a Router.
+type RouterFunc func(r *http.Request) string
+
+// Route calls f(r).
+func (f RouterFunc) Route(r *http.Request) string {
+	return f(r)
+}
+
+// ServerOptions configure a Server.
+type ServerOptions struct {
+	// Authenticator admits tunnel clients. It is required.
+	Authenticator Authenticator
+	// Router picks the tunnel for each public request. If nil, the
+	// Server holds one tunnel, and a new connection closes the previous
+	// one. Otherwise a new connection closes only the previous one with
+	// the same Identity.Name.
+	Router Router
+	// TunnelPath is where clients connect. It defaults to "/tunnel".
+	TunnelPath string
+
+	// AllowTCP lets clients open raw TCP tunnels, each listening on a
+	// port of this process allocated by the OS. It is off by default,
+	// and clients that ask for TCP tunnels are refused.
+	AllowTCP bool
+	// TCPListenAddr is the host TCP tunnels listen on, such as
+	// "127.0.0.1". It defaults to every interface.
+	TCPListenAddr string
+	// MaxTCPTunnels caps the TCP tunnels each client may open, since
+	// each holds a listener. It defaults to 8; clients asking for more
+	// are refused.
+	MaxTCPTunnels int
+
+	// RateLimit caps requests per second to each tunnel, with bursts of
+	// RateBurst, which defaults to one second of requests. Zero means no limit.
+	RateLimit float64
+	RateBurst int
+	// MaxInflight caps concurrent requests to each tunnel. Zero means no limit.
+	MaxInflight int
+	// MaxRequestBody limits public request bodies in bytes. Zero means no limit.
+	MaxRequestBody int64
+	// MaxResponseBody limits response bodies from tunnels in bytes.
+	// Larger responses get 502 Bad Gateway, or are aborted if the size is
+	// only known while streaming. Zero means no limit.
+	MaxResponseBody int64
+	// TrustedProxies are proxies whose X-Forwarded-For is honored
+	// by tunnels' IP filters.
+	TrustedProxies []netip.Prefix
+	// PublicAuth ("user:pass") and PublicToken require credentials of
+	// public callers. A tunnel's own gate applies in addition, never
+	// instead: callers must pass both. Callers pass PublicToken in the
+	// tun_server_token query parameter, apart from a tunnel's tun_token.
+	PublicAuth, PublicToken string
+
+	// Logger receives the server's logs. It defaults to slog.Default().
+	Logger *slog.Logger
+	// Tracer traces public requests, or nil.
+	Tracer *Tracer
+
+	// OnConnect is called after a tunnel connects.
+	OnConnect func(TunnelInfo)
+	// OnDisconnect is called after a tunnel disconnects.
+	OnDisconnect func(TunnelInfo)
+	// OnRequest is called after each public request is answered.
+	OnRequest func(RequestInfo)
+}
+
+// Server accepts tunnel connections and forwards public requests
+// through them. It is an http.Handler: requests to TunnelPath connect
+// tunnels, and all others are forwarded.
+type Server struct {
+	opts     ServerOptions
+	log      *slog.Logger
+	gate     gate // for every tunnel
+	inflight inflight
+	mu       sync.RWMutex
+	tunnels  map[string]*tunnel // by route; "" without a Router
+}
+
+// tunnel is a connected client.
+type tunnel struct {
+	id       string
+	sess     *Session
+	user     string
+	name     string
+	remote   string
+	since    time.Time
+	requests atomic.Int64
+	inflight atomic.Int64 // counted only with a max in flight
+	bucket   *bucket      // nil without a rate limit
+	ips      ipFilter
+	gate     gate // the client's own, checked after the server's
+}
+
+// NewServer checks opts and returns a server ready to serve.
+func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.Authenticator == nil {
+		return nil, errors.New("tun: Authenticator is required")
+	}
+	if opts.TunnelPath == "" {
+		opts.TunnelPath = "/tunnel"
+	}
+	if opts.RateLimit < 0 || math.IsInf(opts.RateLimit, 0) || math.IsNaN(opts.RateLimit) {
+		return nil, fmt.Errorf("tun: invalid RateLimit %v", opts.RateLimit)
+	}
+	if opts.RateLimit > 0 && opts.RateBurst == 0 {
+		opts.RateBurst = max(1, int(math.Ceil(opts.RateLimit)))
+	}
+	if opts.MaxTCPTunnels == 0 {
+		opts.MaxTCPTunnels = defaultMaxTCPTunnels
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	g, err := parseGate(opts.PublicAuth, opts.PublicToken, serverTokenParam)
+	if err != nil {
+		return nil, fmt.Errorf("tun: PublicAuth: %w", err)
+	}
+	return &Server{
+		opts:    opts,
+		log:     opts.Logger,
+		gate:    g,
+		tunnels: make(map[string]*tunnel),
+	}, nil
+}
+
+// logger returns the server's logger, tagged with user if set.
+func (s *Server) logger(user string) *slog.Logger {
+	if user == "" {
+		return s.log
+	}
+	return s.log.With("user", user)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == s.opts.TunnelPath {
+		s.handleTunnel(w, r)
+		return
+	}
+	s.handleRequest(w, r)
+}
+
+func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	id, err := s.opts.Authenticator.Authenticate(r)
+	if err != nil {
+		s.log.Error("tunnel auth error", "err", err, "remote_addr", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, name := id.User, id.Name
+	tid := newID()
+	log := s.logger(user).With("tunnel_id", tid)
+	if name != "" {
+		log = log.With("tunnel_name", name)
+	}
+
+	ips, err := parseIPFilter(r.Header.Get("X-Tunnel-IP-Allow"), r.Header.Get("X-Tunnel-IP-Deny"))
+	if err != nil {
+		log.Error("tunnel ip filter error", "err", err)
+		http.Error(w, "invalid ip filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	g, err := parseGate(r.Header.Get("X-Tunnel-Public-Auth"), r.Header.Get("X-Tunnel-Public-Token"), tunnelTokenParam)
+	if err != nil {
+		log.Error("tunnel gate error", "err", err)
+		http.Error(w, "invalid public auth: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Listen for raw TCP tunnels before upgrading so the allocated
+	// ports can be returned in the handshake response.
+	tcpNames := r.Header.Get("X-Tunnel-TCP")
+	if strings.TrimSpace(tcpNames) != "" && !s.opts.AllowTCP {
+		log.Warn("tcp tunnels not allowed", "tcp", tcpNames)
+		http.Error(w, "tcp tunnels not allowed", http.StatusForbidden)
+		return
+	}
+	tcp, ports, err := listenTCP(tcpNames, s.opts.TCPListenAddr, s.opts.MaxTCPTunnels, ips, log)
+	if errors.Is(err, errTooManyTCP) {
+		log.Warn("too many tcp tunnels", "tcp", tcpNames)
+		http.Error(w, fmt.Sprintf("at most %d tcp tunnels allowed", s.opts.MaxTCPTunnels), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error("tunnel tcp error", "err", err)
+		http.Error(w, "tcp listen error", http.StatusInternalServerError)
+		return
+	}
+	defer tcp.close()
+
+	respHeader := http.Header{}
+	if ports != "" {
+		respHeader.Set("X-Tunnel-TCP", ports)
+	}
+
+	conn, err := upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		log.Error("websocket upgrade error", "err", err)
+		return
+	}
+	sess := NewSession(conn, true)
+	t := &tunnel{
+		id:     tid,
+		sess:   sess,
+		user:   user,
+		name:   name,
+		remote: r.RemoteAddr,
+		since:  time.Now(),
+		ips:    ips,
+		gate:   g,
+	}
+	if s.opts.RateLimit > 0 {
+		t.bucket = newBucket(s.opts.RateLimit, s.opts.RateBurst)
+	}
+
+	// Close the existing session for this route, if any
+	key := ""
+	if s.opts.Router != nil {
+		key = name
+	}
+	s.mu.Lock()
+	old := s.tunnels[key]
+	if old != nil {
+		s.logger(old.user).Info("new tunnel connection, closing previous", "tunnel_id", old.id)
+	}
+	s.tunnels[key] = t
+	s.mu.Unlock()
+
+	// Close old session outside of lock
+	if old != nil {
+		_ = old.sess.Close()
+	}
+
+	log.Info("tunnel connected", "remote_addr", r.RemoteAddr)
+	if s.opts.OnConnect != nil {
+		s.opts.OnConnect(s.info(t))
+	}
+	tcp.start(sess)
+
+	select {
+	case <-sess.GoingAway():
+		log.Info("tunnel draining")
+		<-sess.Done()
+	case <-sess.Done():
+	}
+
+	s.mu.Lock()
+	replaced := s.tunnels[key] != t
+	if !replaced {
+		delete(s.tunnels, key)
+	}
+	s.mu.Unlock()
+
+	// Don't log error if this session was replaced or closed normally
+	err = sess.Err()
+	normalClose := errors.Is(err, ErrSessionClosed) ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+	if !replaced && !normalClose {
+		log.Error("tunnel read error", "err", err)
+	}
+
+	// Only log disconnect if not replaced (replacement logs its own message)
+	if !replaced {
+		log.Info("tunnel disconnected")
+	}
+	if s.opts.OnDisconnect != nil {
+		s.opts.OnDisconnect(s.info(t))
+	}
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	key := ""
+	if s.opts.Router != nil {
+		key = s.opts.Router.Route(r)
+	}
+	s.mu.RLock()
+	t := s.tunnels[key]
+	s.mu.RUnlock()
+
+	var sess *Session
+	var user, tid string
+	if t != nil {
+		sess = t.sess
+		user = t.user
+		tid = t.id
+	}
+
+	id := requestID(r.Header.Get("X-Request-ID"))
+	r.Header.Set("X-Request-ID", id)
+	w.Header().Set("X-Request-ID", id)
+
+	// The span covers the tunnel hop; tun's child span covers the local call.
+	span := s.opts.Tracer.Start(r.Method, SpanServer, r.Header.Get("Traceparent"))
+	if tp := span.Traceparent(); tp != "" {
+		r.Header.Set("Traceparent", tp)
+	}
+
+	if s.opts.MaxRequestBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxRequestBody)
+	}
+	body := &countingReader{r: r.Body}
+	var status int
+	var out int64
+	var err error
+	if !s.allowedIP(t, r) {
+		status = http.StatusForbidden
+		http.Error(w, "forbidden", status)
+	} else if t != nil && !checkGates(w, r, s.gate, t.gate) {
+		status = http.StatusUnauthorized
+	} else if release, retry, ok := t.admit(s.opts.MaxInflight); ok {
+		done := s.track(t, id, r, start)
+		status, out, err = s.forward(w, r, sess, id, body)
+		done()
+		release()
+	} else {
+		status = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		http.Error(w, "too many requests", status)
+	}
+
+	d := time.Since(start)
+	path := r.URL.RequestURI()
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.path", r.URL.Path)
+	span.SetAttr("http.response.status_code", status)
+	span.SetAttr("tun.request_id", id)
+	span.SetAttr("tun.user", user)
+	if err != nil {
+		span.SetAttr("error.type", err.Error())
+	}
+	if status >= 500 || err != nil {
+		span.SetError()
+	}
+	span.Finish()
+	log := s.logger(user)
+	if tid != "" {
+		log = log.With("tunnel_id", tid)
+	}
+	attrs := []any{
+		"request_id", id,
+		"method", r.Method,
+		"path", path,
+		"status", status,
+		"duration_ms", ms(d),
+		"bytes", out,
+	}
+	if err != nil {
+		log.Warn("request", append(attrs, "err", err)...)
+	} else {
+		log.Info("request", attrs...)
+	}
+	if s.opts.OnRequest != nil {
+		s.opts.OnRequest(RequestInfo{
+			ID:           id,
+			Method:       r.Method,
+			Path:         path,
+			Status:       status,
+			Duration:     d,
+			Bytes:        out,
+			User:         user,
+			RequestBytes: body.n,
+		})
+	}
+	// Abort a truncated response, so the caller sees an error rather
+	// than a short body that looks complete.
+	if errors.Is(err, errTruncated) {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// forward proxies r through sess, returning the status written to w and
+// the number of response body bytes. The error, if any, explains a
+// response that failed after the tunnel answered; it wraps errTruncated
+// if the status was already sent.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, sess *Session, id string, body io.Reader) (int, int64, error) {
+	if s.opts.MaxRequestBody > 0 && r.ContentLength > s.opts.MaxRequestBody {
+		return tooLarge(w, s.opts.MaxRequestBody)
+	}
+	if sess == nil {
+		http.Error(w, "no tunnel connected", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable, 0, nil
+	}
+
+	req := Request{
+		ID:      id,
+		Method:  r.Method,
+		Path:    r.URL.RequestURI(),
+		Headers: r.Header,
+		Length:  r.ContentLength,
+	}
+
+	hdr, err := json.Marshal(req)
+	if err != nil {
+		http.Error(w, "marshal error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, 0, nil
+	}
+
+	// Open a stream to the tunnel client
+	st, err := sess.Open(hdr)
+	if errors.Is(err, ErrGoingAway) {
+		http.Error(w, "tunnel draining", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable, 0, nil
+	}
+	if err != nil {
+		http.Error(w, "tunnel write error", http.StatusBadGateway)
+		return http.StatusBadGateway, 0, nil
+	}
+	defer st.Close()
+
+	// Stream the request body; wait for the copy so r.Body is not read
+	// after the handler returns. If the response ends first, reset the
+	// stream and stop reading the body, so a slow uploader can't hold
+	// the handler.
+	var bodyErr error
+	bodyDone := make(chan struct{})
+	go func() {
+		defer close(bodyDone)
+		if _, err := io.Copy(st, body); err != nil {
+			bodyErr = err
+			st.Reset()
+			return
+		}
+		_ = st.CloseWrite()
+	}()
+	stopBody := func() {
+		select {
+		case <-bodyDone:
+		default:
+			st.Reset()
+			_ = http.NewResponseController(w).SetReadDeadline(time.Now())
+			<-bodyDone
+		}
+	}
+	defer stopBody()
+
+	// Wait for the response header with timeout
+	timer := time.AfterFunc(ResponseTimeout, st.Reset)
+	br := bufio.NewReader(st)
+	line, err := br.ReadBytes('\n')
+	if !timer.Stop() {
+		http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+		return http.StatusGatewayTimeout, 0, nil
+	}
+	if err != nil {
+		stopBody()
+		var mbe *http.MaxBytesError
+		if errors.As(bodyErr, &mbe) {
+			return tooLarge(w, mbe.Limit)
+		}
+		if bodyErr != nil && !errors.Is(bodyErr, ErrStreamReset) && !errors.Is(bodyErr, os.ErrDeadlineExceeded) {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return http.StatusBadRequest, 0, nil
+		}
+		http.Error(w, "tunnel read error", http.StatusBadGateway)
+		return http.StatusBadGateway, 0, nil
+	}
+
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		st.Reset()
+		http.Error(w, "invalid tunnel response", http.StatusBadGateway)
+		return http.StatusBadGateway, 0, nil
+	}
+
+	maxRes := s.opts.MaxResponseBody
+	if n, err := strconv.ParseInt(http.Header(resp.Headers).Get("Content-Length"), 10, 64); err == nil && maxRes > 0 && n > maxRes {
+		st.Reset()
+		http.Error(w, fmt.Sprintf("response body exceeds %d bytes", maxRes), http.StatusBadGateway)
+		return http.StatusBadGateway, 0, errResponseTooLarge
+	}
+
+	for k, vals := range resp.Headers {
+		if http.CanonicalHeaderKey(k) == "X-Request-Id" {
+			continue // already set to the public request's ID
+		}
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.Status)
+	var src io.Reader = br
+	if maxRes > 0 {
+		src = &limitedBody{r: br, n: maxRes}
+	}
+	n, err := io.Copy(w, src)
+	if errors.Is(err, errBodyTooLarge) {
+		err = errResponseTooLarge
+	}
+	if err != nil {
+		st.Reset()
+		return resp.Status, n, fmt.Errorf("%w: %w", errTruncated, err)
+	}
+	return resp.Status, n, nil
+}
+
+func tooLarge(w http.ResponseWriter, limit int64) (int, int64, error) {
+	msg := fmt.Sprintf("request body exceeds %d bytes", limit)
+	http.Error(w, msg, http.StatusRequestEntityTooLarge)
+	return http.StatusRequestEntityTooLarge, 0, nil
+}
+
+// Close tells connected tunnels to go away, so their clients reconnect
+// elsewhere, and closes them. Call it after http.Server.Shutdown has
+// drained public requests.
+func (s *Server) Close() error {
+	s.mu.RLock()
+	tunnels := make([]*tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.RUnlock()
+
+	for _, t := range tunnels {
+		t.sess.GoAway()
+		_ = t.sess.Close()
+	}
+	return nil
+}
+
+// TunnelInfo describes a connected tunnel.
+type TunnelInfo struct {
+	ID          string        `json:"id"`
+	User        string        `json:"user,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	RemoteAddr  string        `json:"remote_addr"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	Requests    int64         `json:"requests"`
+	Pending     int           `json:"pending"`
+	RTT         time.Duration `json:"-"` // of the last ping
+}
+
+// Tunnels returns the connected tunnels, oldest first.
+func (s *Server) Tunnels() []TunnelInfo {
+	s.mu.RLock()
+	tunnels := make([]*tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.RUnlock()
+
+	out := make([]TunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		out = append(out, s.info(t))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+func (s *Server) info(t *tunnel) TunnelInfo {
+	pending := 0
+	for _, p := range s.inflight.list() {
+		if p.Tunnel == t.id {
+			pending++
+		}
+	}
+	return TunnelInfo{
+		ID:          t.id,
+		User:        t.user,
+		Name:        t.name,
+		RemoteAddr:  t.remote,
+		ConnectedAt: t.since,
+		Requests:    t.requests.Load(),
+		Pending:     pending,
+		RTT:         t.sess.RTT(),
+	}
+}
+
+// Disconnect closes the tunnel with the given ID, reporting whether
+// it was connected. The Client stops with ErrDisconnected rather than
+// reconnecting.
+func (s *Server) Disconnect(id string) bool {
+	s.mu.RLock()
+	var found *tunnel
+	for _, t := range s.tunnels {
+		if t.id == id {
+			found = t
+		}
+	}
+	s.mu.RUnlock()
+
+	if found == nil {
+		return false
+	}
+	_ = found.sess.closeWith(closeDisconnected)
+	return true
+}
+
+// PendingRequest is a public request waiting on a tunnel.
+type PendingRequest struct {
+	ID         string    `json:"request_id"`
+	Tunnel     string    `json:"tunnel"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// Pending returns the public requests waiting on tunnels, oldest first.
+func (s *Server) Pending() []PendingRequest {
+	return s.inflight.list()
+}
+
+// inflight tracks pending requests. The zero value is ready to use.
+type inflight struct {
+	mu   sync.Mutex
+	reqs map[string]PendingRequest
+}
+
+// add records p until the returned func is called.
+func (f *inflight) add(p PendingRequest) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reqs == nil {
+		f.reqs = make(map[string]PendingRequest)
+	}
+	// Caller-supplied request IDs may repeat; key by a fresh ID.
+	key := newID()
+	f.reqs[key] = p
+	return func() {
+		f.mu.Lock()
+		delete(f.reqs, key)
+		f.mu.Unlock()
+	}
+}
+
+// list returns pending requests, oldest first.
+func (f *inflight) list() []PendingRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	out := make([]PendingRequest, 0, len(f.reqs))
+	for _, p := range f.reqs {
+		p.DurationMs = ms(now.Sub(p.StartedAt))
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// track counts r against t and records it as pending
+// until the returned func is called.
+func (s *Server) track(t *tunnel, id string, r *http.Request, start time.Time) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.requests.Add(1)
+	return s.inflight.add(PendingRequest{
+		ID:        id,
+		Tunnel:    t.id,
+		User:      t.user,
+		Method:    r.Method,
+		Path:      r.URL.RequestURI(),
+		StartedAt: start,
+	})
+}
+
+// countingReader counts bytes read from a request body.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// requestID returns the caller's X-Request-ID if it is usable
+// as a log field and header, or a new ID.
+func requestID(header string) string {
+	if header == "" || len(header) > 128 {
+		return newID()
+	}
+	for i := 0; i < len(header); i++ {
+		if header[i] <= ' ' || header[i] > '~' {
+			return newID()
+		}
+	}
+	return header
+}
+
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
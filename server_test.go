@@ -0,0 +1,550 @@
+package tun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer returns a server requiring the token "secret",
+// and a func returning the requests it has answered.
+func newTestServer(t *testing.T, opts ServerOptions) (*Server, func() []RequestInfo) {
+	t.Helper()
+	var mu sync.Mutex
+	var reqs []RequestInfo
+	if opts.Authenticator == nil {
+		opts.Authenticator = TokenAuth("secret")
+	}
+	opts.OnRequest = func(ri RequestInfo) {
+		mu.Lock()
+		reqs = append(reqs, ri)
+		mu.Unlock()
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() []RequestInfo {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]RequestInfo(nil), reqs...)
+	}
+}
+
+// assertRequest checks that the only answered request was
+// for the tunnel user with the given status.
+func assertRequest(t *testing.T, requests func() []RequestInfo, user string, status int) {
+	t.Helper()
+	got := requests()
+	if len(got) != 1 || got[0].User != user || got[0].Status != status {
+		t.Errorf("requests = %+v, want one for %q with status %d", got, user, status)
+	}
+}
+
+// dialTunnel connects to srv's tunnel endpoint as a client with the
+// token "secret" and the given user.
+func dialTunnel(t *testing.T, srv *httptest.Server, user string) *Session {
+	t.Helper()
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	if user != "" {
+		h.Set("X-Tunnel-User", user)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tunnel", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := NewSession(conn, false)
+	t.Cleanup(func() { _ = sess.Close() })
+	return sess
+}
+
+// waitTunnels waits until s has n tunnels connected.
+func waitTunnels(t *testing.T, s *Server, n int) []TunnelInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tunnels := s.Tunnels()
+		if len(tunnels) == n {
+			return tunnels
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnels = %+v, want %d", tunnels, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewServerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerOptions
+	}{
+		{"no authenticator", ServerOptions{}},
+		{"bad rate limit", ServerOptions{Authenticator: TokenAuth("secret"), RateLimit: -1}},
+		{"bad public auth", ServerOptions{Authenticator: TokenAuth("secret"), PublicAuth: "user"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServer(tt.opts); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	auth := TokenAuth("secret")
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"Bearer secret", true},
+		{"Bearer  secret ", true},
+		{"Bearer wrong", false},
+		{"secret", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/tunnel", nil)
+		r.Header.Set("Authorization", tt.header)
+		r.Header.Set("X-Tunnel-User", "croaky")
+		id, err := auth.Authenticate(r)
+		if tt.ok && (err != nil || id.User != "croaky") {
+			t.Errorf("%q: got %+v, %v; want croaky", tt.header, id, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%q: err = %v, want ErrUnauthorized", tt.header, err)
+		}
+	}
+}
+
+func TestHandleTunnelAuthUnauthorized(t *testing.T) {
+	s, _ := newTestServer(t, ServerOptions{})
+	r := httptest.NewRequest(http.MethodGet, "/tunnel", nil)
+	rw := httptest.NewRecorder()
+
+	s.ServeHTTP(rw, r)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	id := newID()
+
+	// Should be 32 hex chars (16 bytes)
+	if len(id) != 32 {
+		t.Errorf("newID() length = %d, want 32", len(id))
+	}
+
+	// Should be valid hex
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			t.Errorf("newID() contains non-hex char: %c", c)
+		}
+	}
+
+	// Should be unique
+	id2 := newID()
+	if id == id2 {
+		t.Error("newID() returned duplicate IDs")
+	}
+}
+
+func TestHandleRequest_NoTunnel(t *testing.T) {
+	s, requests := newTestServer(t, ServerOptions{})
+
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(`{}`))
+	rw := httptest.NewRecorder()
+
+	s.ServeHTTP(rw, r)
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rw.Code, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(rw.Body.String(), "no tunnel connected") {
+		t.Errorf("body = %q, want 'no tunnel connected'", rw.Body.String())
+	}
+	assertRequest(t, requests, "", http.StatusServiceUnavailable)
+	if got := rw.Header().Get("X-Request-ID"); len(got) != 32 {
+		t.Errorf("X-Request-ID = %q, want generated ID", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		header string
+		keep   bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"has space", false},
+		{"ctl\x00", false},
+		{"café", false},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+	}
+
+	for _, tt := range tests {
+		got := requestID(tt.header)
+		if tt.keep && got != tt.header {
+			t.Errorf("requestID(%q) = %q, want kept", tt.header, got)
+		}
+		if !tt.keep && len(got) != 32 {
+			t.Errorf("requestID(%q) = %q, want generated ID", tt.header, got)
+		}
+	}
+}
+
+func TestHandleRequest_BodyTooLarge(t *testing.T) {
+	s, _ := newTestServer(t, ServerOptions{MaxRequestBody: 8})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	sess := dialTunnel(t, srv, "")
+
+	// Minimal client: read the body, then answer 200.
+	go func() {
+		for {
+			st, err := sess.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(io.Discard, st); err != nil {
+					return
+				}
+				_, _ = st.Write([]byte(`{"status":200}` + "\n"))
+				_ = st.Close()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		length int64
+		want   int
+	}{
+		{"within limit", strings.NewReader("12345678"), 8, http.StatusOK},
+		{"content length", strings.NewReader("123456789"), 9, http.StatusRequestEntityTooLarge},
+		{"chunked", io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789")), -1, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/upload", tt.body)
+			req.ContentLength = tt.length
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("got status %d %q, want %d", res.StatusCode, b, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequest_ResponseTooLarge(t *testing.T) {
+	s, _ := newTestServer(t, ServerOptions{MaxResponseBody: 8})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	sess := dialTunnel(t, srv, "")
+	waitTunnels(t, s, 1)
+
+	// Minimal client: answer with a body sized by the path.
+	go func() {
+		for {
+			st, err := sess.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				var req Request
+				_ = json.Unmarshal(st.Header(), &req)
+				_, _ = io.Copy(io.Discard, st)
+				switch req.Path {
+				case "/small":
+					_, _ = st.Write([]byte(`{"status":200}` + "\n12345678"))
+				case "/length":
+					_, _ = st.Write([]byte(`{"status":200,"headers":{"Content-Length":["9"]}}` + "\n123456789"))
+				case "/chunked":
+					_, _ = st.Write([]byte(`{"status":200}` + "\n123456789"))
+				}
+				_ = st.Close()
+			}()
+		}
+	}()
+
+	get := func(path string) (*http.Response, string, error) {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			return nil, "", err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return res, string(b), err
+	}
+
+	if res, body, err := get("/small"); err != nil || res.StatusCode != http.StatusOK || body != "12345678" {
+		t.Errorf("small: got %v %q, %v; want 200", res, body, err)
+	}
+	if res, body, err := get("/length"); err != nil || res.StatusCode != http.StatusBadGateway || !strings.Contains(body, "exceeds 8 bytes") {
+		t.Errorf("length: got %v %q, %v; want 502 exceeds 8 bytes", res, body, err)
+	}
+	// The status is already sent, so the response is aborted.
+	if _, body, err := get("/chunked"); err == nil {
+		t.Errorf("chunked: got complete body %q, want error", body)
+	}
+}
+
+func TestHandleRequest_TunnelDraining(t *testing.T) {
+	s, _ := newTestServer(t, ServerOptions{})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	sess := dialTunnel(t, srv, "")
+
+	// Wait for the tunnel to register, then for it to see the drain.
+	waitTunnels(t, s, 1)
+	s.mu.RLock()
+	tn := s.tunnels[""]
+	s.mu.RUnlock()
+	sess.GoAway()
+	select {
+	case <-tn.sess.GoingAway():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not see GoAway")
+	}
+
+	res, err := http.Get(srv.URL + "/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "draining") {
+		t.Errorf("got %d %q, want 503 tunnel draining", res.StatusCode, body)
+	}
+}
+
+func TestHandleRequest_SlowUpload(t *testing.T) {
+	s, requests := newTestServer(t, ServerOptions{})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	sess := dialTunnel(t, srv, "")
+	waitTunnels(t, s, 1)
+
+	// The client rejects the request without reading its body.
+	go func() {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = st.Write([]byte(`{"status":403}` + "\n"))
+		_ = st.Close()
+	}()
+
+	// The caller sends part of a large body, then stalls.
+	c, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, _ = io.WriteString(c, "POST /upload HTTP/1.1\r\nHost: tund\r\nContent-Length: 1000000\r\n\r\npartial")
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("no response while the upload stalls: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", res.StatusCode)
+	}
+	assertRequest(t, requests, "", http.StatusForbidden)
+}
+
+// answer serves streams on sess with the tunnel's name until it ends.
+func answer(sess *Session, name string) {
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(io.Discard, st)
+			_, _ = st.Write([]byte(`{"status":200}` + "\n" + name))
+			_ = st.Close()
+		}()
+	}
+}
+
+func TestServerRouter(t *testing.T) {
+	// Tunnels are named by their user, and requests are routed
+	// by the first label of their host.
+	s, _ := newTestServer(t, ServerOptions{
+		Authenticator: AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+			user := r.Header.Get("X-Tunnel-User")
+			return Identity{User: user, Name: user}, nil
+		}),
+		Router: RouterFunc(func(r *http.Request) string {
+			name, _, _ := strings.Cut(r.Host, ".")
+			return name
+		}),
+	})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	for _, name := range []string{"alice", "bob"} {
+		go answer(dialTunnel(t, srv, name), name)
+	}
+	tunnels := waitTunnels(t, s, 2)
+	if tunnels[0].Name == tunnels[1].Name {
+		t.Errorf("tunnels = %+v, want alice and bob", tunnels)
+	}
+
+	for _, tt := range []struct{ host, want string }{
+		{"alice.example.com", "alice"},
+		{"bob.example.com", "bob"},
+		{"carol.example.com", "no tunnel connected\n"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+		req.Host = tt.host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.host, body, tt.want)
+		}
+	}
+
+	// A new connection replaces only the tunnel with its name.
+	go answer(dialTunnel(t, srv, "alice"), "alice")
+	time.Sleep(50 * time.Millisecond)
+	if tunnels := waitTunnels(t, s, 2); tunnels[0].Name != "bob" {
+		t.Errorf("tunnels = %+v, want bob's then alice's", tunnels)
+	}
+}
+
+func TestServerClient(t *testing.T) {
+	connected := make(chan TunnelInfo, 1)
+	disconnected := make(chan TunnelInfo, 1)
+	s, requests := newTestServer(t, ServerOptions{
+		OnConnect:    func(ti TunnelInfo) { connected <- ti },
+		OnDisconnect: func(ti TunnelInfo) { disconnected <- ti },
+	})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient(ClientOptions{
+		Server: "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel",
+		Token:  "secret",
+		User:   "croaky",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte("hello " + string(body)))
+		}),
+		Allow: []Rule{{"POST", "/greet"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	if ti := <-connected; ti.User != "croaky" || ti.ID == "" {
+		t.Errorf("OnConnect = %+v, want croaky's tunnel", ti)
+	}
+
+	res, err := http.Post(srv.URL+"/greet", "text/plain", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello world" {
+		t.Errorf("got %d %q, want 200 hello world", res.StatusCode, body)
+	}
+	got := requests()
+	if len(got) != 1 || got[0].User != "croaky" || got[0].RequestBytes != 5 || got[0].Bytes != 11 {
+		t.Errorf("requests = %+v", got)
+	}
+
+	// Close tells the client to reconnect, which it does right away.
+	_ = s.Close()
+	if ti := <-disconnected; ti.User != "croaky" {
+		t.Errorf("OnDisconnect = %+v, want croaky's tunnel", ti)
+	}
+	<-connected
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+}
+
+func TestHandleTunnelTCP(t *testing.T) {
+	dial := func(t *testing.T, opts ServerOptions, names string) (*http.Response, error) {
+		s, _ := newTestServer(t, opts)
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+		t.Cleanup(func() { _ = s.Close() })
+		h := http.Header{}
+		h.Set("Authorization", "Bearer secret")
+		h.Set("X-Tunnel-TCP", names)
+		conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tunnel", h)
+		if err == nil {
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+		return res, err
+	}
+
+	// TCP tunnels are off by default.
+	res, err := dial(t, ServerOptions{}, "pg")
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("without AllowTCP: got %v, %v; want 403", res, err)
+	}
+
+	// Each tunnel holds a listener, so clients may open only a few.
+	opts := ServerOptions{AllowTCP: true, TCPListenAddr: "127.0.0.1", MaxTCPTunnels: 2}
+	res, err = dial(t, opts, "a b c")
+	if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("over MaxTCPTunnels: got %v, %v; want 400", res, err)
+	}
+	if res, err = dial(t, opts, "a b a"); err != nil {
+		t.Fatalf("repeated names within MaxTCPTunnels: got %v, %v", res, err)
+	}
+
+	res, err = dial(t, ServerOptions{AllowTCP: true, TCPListenAddr: "127.0.0.1"}, "pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, ok := strings.Cut(res.Header.Get("X-Tunnel-TCP"), "pg=")
+	if !ok {
+		t.Fatalf("X-Tunnel-TCP = %q, want pg=port", res.Header.Get("X-Tunnel-TCP"))
+	}
+	c, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("dial loopback: %v", err)
+	}
+	_ = c.Close()
+}
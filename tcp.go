@@ -0,0 +1,119 @@
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// tcpRelay exposes a client's named TCP tunnels on public ports
+// and relays each accepted connection as a stream.
+type tcpRelay struct {
+	log *slog.Logger // tagged with the tunnel user
+	ips ipFilter     // the tunnel's IP filter, checked on each connection
+	lns map[string]net.Listener
+}
+
+// errTooManyTCP means a client asked for more TCP tunnels than allowed.
+var errTooManyTCP = errors.New("too many tcp tunnels")
+
+// listenTCP opens a listener on host, with a port allocated by the OS,
+// for each tunnel name requested in the X-Tunnel-TCP header, up to max
+// names. It returns the relay and a "name=port ..." summary for the
+// upgrade response. An empty host listens on every interface.
+// Connections from addresses ips doesn't allow are closed.
+func listenTCP(header, host string, max int, ips ipFilter, log *slog.Logger) (*tcpRelay, string, error) {
+	t := &tcpRelay{
+		log: log,
+		ips: ips,
+		lns: make(map[string]net.Listener),
+	}
+	var ports []string
+	for _, name := range strings.Fields(header) {
+		if _, ok := t.lns[name]; ok {
+			continue
+		}
+		if len(t.lns) == max {
+			t.close()
+			return nil, "", errTooManyTCP
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			t.close()
+			return nil, "", fmt.Errorf("listen tcp %s: %w", name, err)
+		}
+		t.lns[name] = ln
+		ports = append(ports, fmt.Sprintf("%s=%d", name, ln.Addr().(*net.TCPAddr).Port))
+	}
+	return t, strings.Join(ports, " "), nil
+}
+
+// start begins accepting public connections once the tunnel is upgraded.
+func (t *tcpRelay) start(sess *Session) {
+	for name, ln := range t.lns {
+		t.log.Info("tcp listening",
+			"tcp", name,
+			"addr", ln.Addr().String(),
+		)
+		go t.accept(sess, name, ln)
+	}
+}
+
+func (t *tcpRelay) accept(sess *Session, name string, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		if !t.allowed(name, c.RemoteAddr()) {
+			_ = c.Close()
+			continue
+		}
+
+		id := newID()
+		hdr, err := json.Marshal(Request{ID: id, TCP: name})
+		if err != nil {
+			_ = c.Close()
+			continue
+		}
+		st, err := sess.Open(hdr)
+		if err != nil {
+			_ = c.Close()
+			continue
+		}
+		t.log.Info("tcp connection open",
+			"request_id", id,
+			"tcp", name,
+			"remote_addr", c.RemoteAddr().String(),
+		)
+		go Pipe(st, c)
+	}
+}
+
+// allowed reports whether the IP filter admits addr. Raw TCP has no
+// X-Forwarded-For, so the peer address is the caller.
+func (t *tcpRelay) allowed(name string, addr net.Addr) bool {
+	if !t.ips.enabled() {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err == nil && t.ips.allowed(ap.Addr().Unmap()) {
+		return true
+	}
+	t.log.Warn("blocked by ip filter", "tcp", name, "client_ip", ap.Addr().Unmap().String())
+	return false
+}
+
+// close stops all listeners. Open connections end with the session.
+func (t *tcpRelay) close() {
+	for _, ln := range t.lns {
+		_ = ln.Close()
+	}
+	if len(t.lns) > 0 {
+		t.log.Info("tcp listeners closed")
+	}
+}
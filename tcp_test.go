@@ -0,0 +1,64 @@
+package tun
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPRelayIPFilter(t *testing.T) {
+	srv, cli := sessionPair(t)
+	log := slog.New(slog.DiscardHandler)
+
+	tests := []struct {
+		name  string
+		deny  string
+		allow bool
+	}{
+		{"allowed", "", true},
+		{"denied", "127.0.0.0/8 ::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, err := parseIPFilter("", tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relay, ports, err := listenTCP("pg", "127.0.0.1", 1, ips, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer relay.close()
+			if ports == "" {
+				t.Fatal("no ports")
+			}
+			relay.start(srv)
+
+			c, err := net.Dial("tcp", relay.lns["pg"].Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if !tt.allow {
+				_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("read from denied connection: err = %v, want EOF", err)
+				}
+				return
+			}
+			st, err := cli.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			var req Request
+			if err := json.Unmarshal(st.Header(), &req); err != nil || req.TCP != "pg" {
+				t.Errorf("stream header = %s, want TCP pg", st.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package tun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP.
+const (
+	SpanServer = 2
+	SpanClient = 3
+)
+
+const (
+	exportInterval = time.Second
+	maxQueuedSpans = 2048
+)
+
+// Tracer records spans and exports them in batches to an OTLP/HTTP
+// collector as JSON. A nil *Tracer records nothing.
+type Tracer struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu    sync.Mutex
+	spans []*Span
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewTracer returns a tracer exporting to the collector at endpoint,
+// such as "http://localhost:4318", or nil if endpoint is empty.
+func NewTracer(endpoint, service string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	t := &Tracer{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Start begins a span. If traceparent is a valid W3C trace context
+// header, the span is its child; otherwise the span starts a new trace.
+func (t *Tracer) Start(name string, kind int, traceparent string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer:  t,
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+		sampled: true,
+	}
+	if trace, parent, flags, ok := ParseTraceparent(traceparent); ok {
+		s.TraceID = trace
+		s.ParentID = parent
+		s.sampled = flags&1 == 1
+	} else {
+		_, _ = rand.Read(s.TraceID[:])
+	}
+	_, _ = rand.Read(s.SpanID[:])
+	return s
+}
+
+// Close exports any queued spans and stops the tracer.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	tick := time.NewTicker(exportInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.export()
+		case <-t.stop:
+			t.export()
+			return
+		}
+	}
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) < maxQueuedSpans {
+		t.spans = append(t.spans, s)
+	}
+}
+
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.payload(spans))
+	if err != nil {
+		slog.Error("trace export error", "err", err)
+		return
+	}
+	res, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("trace export error", "err", err)
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		err := fmt.Errorf("collector returned %s", res.Status)
+		slog.Error("trace export error", "err", err)
+	}
+}
+
+// payload builds an OTLP ExportTraceServiceRequest in its JSON encoding.
+func (t *Tracer) payload(spans []*Span) any {
+	out := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attributes(s.attrs),
+		}
+		if s.ParentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.err {
+			span["status"] = map[string]any{"code": 2}
+		}
+		out = append(out, span)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": attributes([]attr{{"service.name", t.service}}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/croaky/tun"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+type attr struct {
+	key   string
+	value any
+}
+
+func attributes(attrs []attr) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]any
+		switch x := a.value.(type) {
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]any{"key": a.key, "value": v})
+	}
+	return out
+}
+
+// Span is a timed operation in a trace. A nil *Span records nothing.
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // zero for a root span
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+
+	tracer  *Tracer
+	attrs   []attr
+	err     bool
+	sampled bool
+}
+
+// SetAttr records an attribute. Values are exported as integers
+// if int or int64, and as strings otherwise.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attr{key, value})
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError() {
+	if s == nil {
+		return
+	}
+	s.err = true
+}
+
+// Traceparent returns the W3C trace context header naming s as the parent.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-" + flags
+}
+
+// Finish ends the span and queues it for export if sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.sampled {
+		s.tracer.queue(s)
+	}
+}
+
+// ParseTraceparent parses a W3C trace context header
+// ("00-<trace id>-<parent id>-<flags>").
+func ParseTraceparent(h string) (trace [16]byte, parent [8]byte, flags byte, ok bool) {
+	h = strings.TrimSpace(h)
+	if h != strings.ToLower(h) {
+		return trace, parent, 0, false
+	}
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return trace, parent, 0, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return trace, parent, 0, false
+	}
+	var f [1]byte
+	if _, err := hex.Decode(trace[:], []byte(parts[1])); err != nil {
+		return trace, parent, 0, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil {
+		return trace, parent, 0, false
+	}
+	if _, err := hex.Decode(f[:], []byte(parts[3])); err != nil {
+		return trace, parent, 0, false
+	}
+	if trace == [16]byte{} || parent == [8]byte{} {
+		return trace, parent, 0, false
+	}
+	return trace, parent, f[0], true
+}
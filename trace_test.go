@@ -0,0 +1,196 @@
+package tun
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+		flags  byte
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, 1},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, 0},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, 1},
+		{"", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, 0},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, 0},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, 0},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false, 0},
+	}
+
+	for _, tt := range tests {
+		trace, parent, flags, ok := ParseTraceparent(tt.header)
+		if ok != tt.ok {
+			t.Errorf("ParseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := hex.EncodeToString(trace[:]); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("ParseTraceparent(%q) trace = %s", tt.header, got)
+		}
+		if got := hex.EncodeToString(parent[:]); got != "00f067aa0ba902b7" {
+			t.Errorf("ParseTraceparent(%q) parent = %s", tt.header, got)
+		}
+		if flags != tt.flags {
+			t.Errorf("ParseTraceparent(%q) flags = %d, want %d", tt.header, flags, tt.flags)
+		}
+	}
+}
+
+// otlpRequest is the part of an OTLP/HTTP JSON export the tests inspect.
+type otlpRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Attributes   []otlpAttr `json:"attributes"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+	Service string `json:"-"`
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+		IntValue    string `json:"intValue"`
+	} `json:"value"`
+}
+
+// collector returns an OTLP/HTTP endpoint and a function
+// returning the spans it has received.
+func collector(t *testing.T) (string, func() []otlpSpan) {
+	t.Helper()
+	var mu sync.Mutex
+	var spans []otlpSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s %s, want JSON POST to /v1/traces", r.Method, r.URL.Path)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode export: %v", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			var service string
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					service = a.Value.StringValue
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					s.Service = service
+					spans = append(spans, s)
+				}
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []otlpSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]otlpSpan(nil), spans...)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	endpoint, spans := collector(t)
+	tr := NewTracer(endpoint, "tund")
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	server := tr.Start("POST", SpanServer, incoming)
+	server.SetAttr("http.response.status_code", 502)
+	server.SetError()
+	child := tr.Start("POST", SpanClient, server.Traceparent())
+	child.Finish()
+	server.Finish()
+
+	// Unsampled traces propagate but are not exported
+	tr.Start("GET", SpanServer, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00").Finish()
+
+	tr.Close()
+
+	got := spans()
+	if len(got) != 2 {
+		t.Fatalf("exported %d spans, want 2: %+v", len(got), got)
+	}
+	c, s := got[0], got[1]
+	if s.Service != "tund" || s.Name != "POST" || s.Kind != SpanServer {
+		t.Errorf("server span = %+v", s)
+	}
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span trace %s parent %s, want incoming context", s.TraceID, s.ParentSpanID)
+	}
+	if s.Status.Code != 2 {
+		t.Errorf("server span status = %d, want error", s.Status.Code)
+	}
+	if len(s.Attributes) != 1 || s.Attributes[0].Value.IntValue != "502" {
+		t.Errorf("server span attributes = %+v", s.Attributes)
+	}
+	if c.TraceID != s.TraceID || c.ParentSpanID != s.SpanID || c.Kind != SpanClient {
+		t.Errorf("client span = %+v, want child of %s", c, s.SpanID)
+	}
+}
+
+func TestTracerNewTrace(t *testing.T) {
+	tr := NewTracer("http://127.0.0.1:1", "tun")
+	defer tr.Close()
+
+	s := tr.Start("GET", SpanServer, "invalid")
+	if s.ParentID != [8]byte{} {
+		t.Errorf("parent = %x, want root span", s.ParentID)
+	}
+	tp := s.Traceparent()
+	if _, _, flags, ok := ParseTraceparent(tp); !ok || flags != 1 {
+		t.Errorf("Traceparent() = %q, want sampled trace context", tp)
+	}
+	if !strings.Contains(tp, hex.EncodeToString(s.SpanID[:])) {
+		t.Errorf("Traceparent() = %q, want span ID %x", tp, s.SpanID)
+	}
+}
+
+func TestTracerNil(t *testing.T) {
+	var tr *Tracer
+	if NewTracer("", "tun") != nil {
+		t.Error("NewTracer with no endpoint should be nil")
+	}
+
+	s := tr.Start("GET", SpanServer, "")
+	s.SetAttr("k", "v")
+	s.SetError()
+	s.Finish()
+	if tp := s.Traceparent(); tp != "" {
+		t.Errorf("Traceparent() = %q, want empty", tp)
+	}
+	tr.Close()
+}
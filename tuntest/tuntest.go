@@ -0,0 +1,157 @@
+// Package tuntest runs a tunnel server and client in-process,
+// so tests can send requests through the full tunnel path
+// to an http.Handler.
+package tuntest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/croaky/tun"
+)
+
+// token authenticates the client unless the options set their own.
+const token = "tuntest"
+
+// connectTimeout bounds how long Start waits for the tunnel to connect.
+const connectTimeout = 10 * time.Second
+
+// A Server is a tun.Server listening on a loopback address,
+// with a tun.Client connected that serves its requests.
+type Server struct {
+	// URL is the public base URL, such as "http://127.0.0.1:1234".
+	// Requests to it go through the tunnel.
+	URL string
+
+	// ServerOptions and ClientOptions configure the tunnel.
+	// They may be changed after NewUnstartedServer and before Start.
+	// Start fills in the Authenticator, Server, Token, and Handler,
+	// and discards logs, unless they are set. It sets AllowAll unless
+	// Allow is set, so every request reaches the handler.
+	ServerOptions tun.ServerOptions
+	ClientOptions tun.ClientOptions
+
+	// Tund and Tun are the tunnel server and client, set by Start.
+	Tund *tun.Server
+	Tun  *tun.Client
+
+	handler http.Handler
+	public  *httptest.Server
+	cancel  context.CancelFunc
+	done    chan error
+}
+
+// NewServer starts a tunnel to h and returns once it is connected.
+// The caller should call Close when finished.
+func NewServer(h http.Handler) *Server {
+	s := NewUnstartedServer(h)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a tunnel to h without starting it.
+// Change its options, then call Start.
+func NewUnstartedServer(h http.Handler) *Server {
+	return &Server{handler: h}
+}
+
+// Start starts the server and client and waits for the tunnel
+// to connect. It panics on failure, like httptest.Server.Start.
+func (s *Server) Start() {
+	if s.Tun != nil {
+		panic("tuntest: Server already started")
+	}
+	discard := slog.New(slog.DiscardHandler)
+
+	sopts := s.ServerOptions
+	if sopts.Authenticator == nil {
+		sopts.Authenticator = tun.TokenAuth(token)
+	}
+	if sopts.Logger == nil {
+		sopts.Logger = discard
+	}
+	ts, err := tun.NewServer(sopts)
+	if err != nil {
+		panic(fmt.Sprintf("tuntest: %v", err))
+	}
+	s.Tund = ts
+	s.public = httptest.NewServer(ts)
+	s.URL = s.public.URL
+
+	copts := s.ClientOptions
+	if copts.Server == "" {
+		path := sopts.TunnelPath
+		if path == "" {
+			path = "/tunnel"
+		}
+		copts.Server = "ws" + strings.TrimPrefix(s.URL, "http") + path
+	}
+	if copts.Token == "" && s.ServerOptions.Authenticator == nil {
+		copts.Token = token
+	}
+	if copts.Handler == nil && copts.Local == "" {
+		copts.Handler = s.handler
+	}
+	if copts.Logger == nil {
+		copts.Logger = discard
+	}
+	if len(copts.Allow) == 0 {
+		copts.AllowAll = true
+	}
+	connected := make(chan struct{}, 1)
+	onConnect := copts.OnConnect
+	copts.OnConnect = func(ci tun.ConnectInfo) {
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+		if onConnect != nil {
+			onConnect(ci)
+		}
+	}
+	c, err := tun.NewClient(copts)
+	if err != nil {
+		s.public.Close()
+		panic(fmt.Sprintf("tuntest: %v", err))
+	}
+	s.Tun = c
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan error, 1)
+	go func() { s.done <- c.Run(ctx) }()
+
+	select {
+	case <-connected:
+	case err := <-s.done:
+		s.done <- err
+		s.Close()
+		panic(fmt.Sprintf("tuntest: client stopped: %v", err))
+	case <-time.After(connectTimeout):
+		s.Close()
+		panic("tuntest: tunnel did not connect")
+	}
+}
+
+// Client returns an HTTP client for requests to URL.
+func (s *Server) Client() *http.Client {
+	return s.public.Client()
+}
+
+// Close disconnects the tunnel, waiting for in-flight requests,
+// and shuts down the server.
+func (s *Server) Close() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.cancel = nil
+	<-s.done
+	s.public.Close()
+	_ = s.Tund.Close()
+}
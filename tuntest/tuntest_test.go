@@ -0,0 +1,83 @@
+package tuntest
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/croaky/tun"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "ok")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer s.Close()
+
+	res, err := s.Client().Post(s.URL+"/hooks/stripe?x=1", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if want := "POST /hooks/stripe?x=1 hi"; res.StatusCode != http.StatusCreated || string(b) != want {
+		t.Errorf("got %d %q, want 201 %q", res.StatusCode, b, want)
+	}
+	if res.Header.Get("X-Test") != "ok" {
+		t.Errorf("X-Test = %q, want ok", res.Header.Get("X-Test"))
+	}
+	if res.Header.Get("X-Request-ID") == "" {
+		t.Error("X-Request-ID not set by tund")
+	}
+
+	if n := len(s.Tund.Tunnels()); n != 1 {
+		t.Errorf("tunnels = %d, want 1", n)
+	}
+	s.Close()
+	s.Close()
+}
+
+func TestUnstartedServer(t *testing.T) {
+	var requests []tun.RequestInfo
+	s := NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	s.ServerOptions.PublicAuth = "user:pass"
+	s.ServerOptions.OnRequest = func(ri tun.RequestInfo) { requests = append(requests, ri) }
+	s.ClientOptions.User = "croaky"
+	s.ClientOptions.Allow = []tun.Rule{{Method: "POST", Path: "/hook"}}
+	s.Start()
+	defer s.Close()
+
+	do := func(method, path string, auth bool) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, s.URL+path, nil)
+		if auth {
+			req.SetBasicAuth("user", "pass")
+		}
+		res, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := do("POST", "/hook", false); code != http.StatusUnauthorized {
+		t.Errorf("without public auth: status %d, want 401", code)
+	}
+	if code := do("POST", "/hook", true); code != http.StatusOK {
+		t.Errorf("allowed request: status %d, want 200", code)
+	}
+	if code := do("GET", "/other", true); code != http.StatusForbidden {
+		t.Errorf("disallowed request: status %d, want 403", code)
+	}
+
+	s.Close()
+	if len(requests) != 3 || requests[1].User != "croaky" {
+		t.Errorf("OnRequest got %+v, want 3 requests by croaky", requests)
+	}
+}
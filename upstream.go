@@ -0,0 +1,195 @@
+package tun
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// upstream is a local service that tunneled requests are forwarded to.
+type upstream struct {
+	base   string // prepended to request paths
+	client *http.Client
+}
+
+// newUpstreams builds an upstream for local and each route target,
+// keyed by target URL.
+func newUpstreams(local string, routes []Route, tlsCfg *tls.Config) (map[string]*upstream, error) {
+	targets := []string{}
+	if local != "" {
+		targets = append(targets, local)
+	}
+	for _, r := range routes {
+		targets = append(targets, r.Target)
+	}
+
+	ups := make(map[string]*upstream)
+	for _, target := range targets {
+		if _, ok := ups[target]; ok {
+			continue
+		}
+		u, err := newUpstream(target, tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		ups[target] = u
+	}
+	return ups, nil
+}
+
+// newUpstream returns an upstream for an http://, https://, or
+// unix:///path.sock target.
+func newUpstream(target string, tlsCfg *tls.Config) (*upstream, error) {
+	tr, base, err := LocalTransport(target, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{
+		base:   strings.TrimSuffix(base.String(), "/"),
+		client: &http.Client{Timeout: RequestTimeout, Transport: tr},
+	}, nil
+}
+
+// LocalTransport returns the transport a Client uses to reach target,
+// an http://, https://, or unix:///path.sock local service, and the
+// URL requests to it are sent to. TLS configures https targets.
+func LocalTransport(target string, tlsCfg *tls.Config) (*http.Transport, *url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("local target %q: %w", target, err)
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "http":
+	case "https":
+		if tlsCfg != nil {
+			tr.TLSClientConfig = tlsCfg.Clone()
+		}
+	case "unix":
+		if u.Path == "" {
+			return nil, nil, fmt.Errorf("local target %q: missing socket path", target)
+		}
+		sock := u.Path
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+		tr.Proxy = nil
+		// The host is ignored by the dialer but required by net/http.
+		u = &url.URL{Scheme: "http", Host: "unix"}
+	default:
+		return nil, nil, fmt.Errorf("local target %q: unsupported scheme %q", target, u.Scheme)
+	}
+	return tr, u, nil
+}
+
+// handlerUpstream returns an upstream that serves requests with h in-process.
+func handlerUpstream(h http.Handler) *upstream {
+	return &upstream{
+		// The host is ignored by the transport but required by net/http.
+		base:   "http://handler",
+		client: &http.Client{Timeout: RequestTimeout, Transport: handlerTransport{h}},
+	}
+}
+
+// handlerTransport is an http.RoundTripper that calls a handler directly.
+// The response body streams from the handler's writes as they happen.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.RequestURI = r.URL.RequestURI()
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	pr, pw := io.Pipe()
+	w := &pipeResponse{header: http.Header{}, pw: pw, sent: make(chan struct{})}
+	go func() {
+		defer r.Body.Close()
+		defer func() {
+			if v := recover(); v != nil {
+				err := fmt.Errorf("handler panic: %v", v)
+				w.fail(err)
+				pw.CloseWithError(err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			pw.Close()
+		}()
+		t.h.ServeHTTP(w, r)
+	}()
+
+	select {
+	case <-w.sent:
+	case <-req.Context().Done():
+		pr.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sentHeader,
+		Body:          pr,
+		ContentLength: -1,
+		Request:       req,
+	}
+	if n, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err == nil {
+		res.ContentLength = n
+	}
+	return res, nil
+}
+
+// pipeResponse is the http.ResponseWriter given to a handler by
+// handlerTransport. Writes block until the tunnel reads them.
+type pipeResponse struct {
+	header     http.Header
+	pw         *io.PipeWriter
+	once       sync.Once
+	sent       chan struct{} // closed once the status is set, or on failure
+	status     int
+	sentHeader http.Header
+	err        error // set if the handler failed before sending a status
+}
+
+func (w *pipeResponse) Header() http.Header { return w.header }
+
+func (w *pipeResponse) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		w.sentHeader = w.header.Clone()
+		close(w.sent)
+	})
+}
+
+func (w *pipeResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+// Flush is a no-op: writes reach the tunnel unbuffered.
+func (w *pipeResponse) Flush() {}
+
+func (w *pipeResponse) fail(err error) {
+	w.once.Do(func() {
+		w.err = err
+		close(w.sent)
+	})
+}
@@ -0,0 +1,137 @@
+package tun
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewUpstream_Unix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	up, err := newUpstream("unix://"+sock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, up, "/slack/events", "/slack/events")
+}
+
+func TestNewUpstream_HTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Run("untrusted", func(t *testing.T) {
+		up, err := newUpstream(srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := up.client.Get(up.base + "/")
+		if err == nil {
+			res.Body.Close()
+			t.Fatal("want certificate error, got nil")
+		}
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		up, err := newUpstream(srv.URL, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertGet(t, up, "/", "ok")
+	})
+
+	t.Run("custom CA", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		up, err := newUpstream(srv.URL, &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertGet(t, up, "/", "ok")
+	})
+}
+
+func TestNewUpstream_Errors(t *testing.T) {
+	for _, target := range []string{"unix://", "ftp://localhost"} {
+		t.Run(target, func(t *testing.T) {
+			if _, err := newUpstream(target, nil); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestHandlerUpstream(t *testing.T) {
+	up := handlerUpstream(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(body)
+		case "/panic":
+			panic("boom")
+		case "/panic-late":
+			_, _ = w.Write([]byte("partial"))
+			panic("boom")
+		}
+	}))
+
+	res, err := up.client.Post(up.base+"/echo?x=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || res.Header.Get("X-Method") != "POST" || string(body) != "hello" {
+		t.Errorf("echo = %d %v %q", res.StatusCode, res.Header, body)
+	}
+
+	// Handlers that write nothing answer 200.
+	assertGet(t, up, "/empty", "")
+
+	if _, err := up.client.Get(up.base + "/panic"); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("panic before status: err = %v, want handler panic", err)
+	}
+
+	res, err = up.client.Get(up.base + "/panic-late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil {
+		t.Error("panic after status: body read succeeded")
+	}
+}
+
+func assertGet(t *testing.T, up *upstream, path, want string) {
+	t.Helper()
+	res, err := up.client.Get(up.base + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}